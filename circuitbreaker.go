@@ -0,0 +1,154 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// CircuitState is the state of a CircuitBreaker
+type CircuitState int
+
+const (
+	// CircuitClosed lets every request through
+	CircuitClosed CircuitState = iota
+	// CircuitOpen rejects every request until the recovery timeout is over
+	CircuitOpen
+	// CircuitHalfOpen lets a single probe request through
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half_open"
+	default:
+		return "closed"
+	}
+}
+
+// CircuitBreaker stops sending requests to the upstream after too many
+// consecutive failures, and probes it again after the recovery timeout
+type CircuitBreaker struct {
+	mu        sync.Mutex
+	state     CircuitState
+	failures  int
+	openedAt  time.Time
+	probing   bool
+	threshold int
+	timeout   time.Duration
+
+	// OnStateChange is called with the new state on every transition
+	OnStateChange func(state CircuitState)
+}
+
+// NewCircuitBreaker create a circuit breaker which opens after threshold
+// consecutive failures. A threshold <= 0 disables the breaker.
+func NewCircuitBreaker(threshold int, timeout time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{threshold: threshold, timeout: timeout}
+}
+
+// Allow reports whether a request may be sent to the upstream
+func (b *CircuitBreaker) Allow() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case CircuitOpen:
+		if time.Since(b.openedAt) < b.timeout {
+			return false
+		}
+		b.setState(CircuitHalfOpen)
+		b.probing = true
+		return true
+	case CircuitHalfOpen:
+		// Only one probe at a time
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// Available reports whether Allow could let a request through,
+// without moving the breaker into half-open state
+func (b *CircuitBreaker) Available() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case CircuitOpen:
+		return time.Since(b.openedAt) >= b.timeout
+	case CircuitHalfOpen:
+		return !b.probing
+	default:
+		return true
+	}
+}
+
+// Success records a successful upstream request
+func (b *CircuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.setState(CircuitClosed)
+	b.failures = 0
+	b.probing = false
+}
+
+// Failure records a failed upstream request
+func (b *CircuitBreaker) Failure() {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.state == CircuitHalfOpen || b.failures >= b.threshold {
+		b.setState(CircuitOpen)
+		b.openedAt = time.Now()
+		b.probing = false
+	}
+}
+
+// Cancel record a request which was not sent, e.g. for lack of an
+// UPSTREAM_MAX_CONCURRENT slot. A half-open probe is released so another one can be sent.
+func (b *CircuitBreaker) Cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+}
+
+func (b *CircuitBreaker) setState(state CircuitState) {
+	if b.state == state {
+		return
+	}
+
+	b.state = state
+	if b.OnStateChange != nil {
+		b.OnStateChange(state)
+	}
+}
+
+// State returns the current state of the breaker
+func (b *CircuitBreaker) State() CircuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	breaker := NewCircuitBreaker(3, 50*time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		assert.True(t, breaker.Allow())
+		breaker.Failure()
+	}
+	assert.Equal(t, CircuitClosed, breaker.State(), "should be closed below the threshold")
+
+	breaker.Failure()
+	assert.Equal(t, CircuitOpen, breaker.State(), "should open at the threshold")
+	assert.False(t, breaker.Allow(), "should reject requests when open")
+
+	time.Sleep(60 * time.Millisecond)
+	assert.True(t, breaker.Allow(), "should allow a probe after the timeout")
+	assert.Equal(t, CircuitHalfOpen, breaker.State())
+	assert.False(t, breaker.Allow(), "should allow a single probe only")
+
+	breaker.Failure()
+	assert.Equal(t, CircuitOpen, breaker.State(), "failed probe should open the breaker again")
+
+	time.Sleep(60 * time.Millisecond)
+	assert.True(t, breaker.Allow())
+	breaker.Success()
+	assert.Equal(t, CircuitClosed, breaker.State(), "successful probe should close the breaker")
+	assert.True(t, breaker.Allow())
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	breaker := NewCircuitBreaker(0, time.Minute)
+
+	for i := 0; i < 10; i++ {
+		breaker.Failure()
+	}
+	assert.True(t, breaker.Allow())
+	assert.Equal(t, CircuitClosed, breaker.State())
+}
+
+func TestCircuitBreakerCancelProbe(t *testing.T) {
+	breaker := NewCircuitBreaker(1, 10*time.Millisecond)
+	breaker.Failure()
+
+	time.Sleep(20 * time.Millisecond)
+	assert.True(t, breaker.Allow())
+	assert.False(t, breaker.Allow())
+
+	breaker.Cancel()
+	assert.Equal(t, CircuitHalfOpen, breaker.State(), "cancelled probe should not change the state")
+	assert.True(t, breaker.Allow(), "another probe should be allowed")
+}
@@ -1,21 +1,777 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/kelseyhightower/envconfig"
+	"gopkg.in/yaml.v3"
 )
 
 // Config contains config
 type Config struct {
-	RoutePrefix                string `env:"ROUTE_PREFIX"`
-	GoogleOrigin               string `env:"GOOGLE_ORIGIN" default:"https://www.google-analytics.com"`
-	InjectParamsFromReqHeaders string `env:"INJECT_PARAMS_FROM_REQ_HEADERS"`
-	SkipParamsFromReqHeaders   string `env:"SKIP_PARAMS_FROM_REQ_HEADERS"`
-	Port                       string `env:"PORT" default:"3000"`
+	RoutePrefix                 string        `envconfig:"ROUTE_PREFIX"`
+	RoutePrefixRegex            bool          `envconfig:"ROUTE_PREFIX_REGEX" default:"false"`
+	GoogleOrigin                string        `envconfig:"GOOGLE_ORIGIN" default:"https://www.google-analytics.com"`
+	GoogleOrigins               string        `envconfig:"GOOGLE_ORIGINS"`
+	UpstreamWeights             string        `envconfig:"UPSTREAM_WEIGHTS"`
+	InjectParamsFromReqHeaders  string        `envconfig:"INJECT_PARAMS_FROM_REQ_HEADERS"`
+	SkipParamsFromReqHeaders    string        `envconfig:"SKIP_PARAMS_FROM_REQ_HEADERS"`
+	BodyReplaceContentTypes     string        `envconfig:"BODY_REPLACE_CONTENT_TYPES" default:"text/javascript,application/javascript"`
+	ForwardCookieNames          string        `envconfig:"FORWARD_COOKIE_NAMES"`
+	InjectIntegrityHash         bool          `envconfig:"INJECT_INTEGRITY_HASH"`
+	CachePassthroughHeaders     bool          `envconfig:"CACHE_PASSTHROUGH_HEADERS"`
+	StripResponseHeaders        []string      `envconfig:"STRIP_RESPONSE_HEADERS" default:"Set-Cookie,Server"`
+	AddResponseHeaders          []string      `envconfig:"ADD_RESPONSE_HEADERS"`
+	MaxURILength                int           `envconfig:"MAX_URI_LENGTH" default:"8192"`
+	MaxPathLength               int           `envconfig:"MAX_PATH_LENGTH" default:"2048"`
+	StrictGA4Validation         bool          `envconfig:"STRICT_GA4_VALIDATION"`
+	RequestMaxBodySize          string        `envconfig:"REQUEST_MAX_BODY_SIZE" default:"1MB"`
+	UpstreamCBThreshold         int           `envconfig:"UPSTREAM_CB_THRESHOLD" default:"5"`
+	UpstreamCBTimeout           time.Duration `envconfig:"UPSTREAM_CB_TIMEOUT" default:"30s"`
+	UpstreamMaxResponseSize     string        `envconfig:"UPSTREAM_MAX_RESPONSE_SIZE" default:"10MB"`
+	UpstreamTLSCertFile         string        `envconfig:"UPSTREAM_TLS_CERT_FILE"`
+	UpstreamTLSKeyFile          string        `envconfig:"UPSTREAM_TLS_KEY_FILE"`
+	UpstreamTLSCAFile           string        `envconfig:"UPSTREAM_TLS_CA_FILE"`
+	UpstreamDNSCacheTTL         time.Duration `envconfig:"UPSTREAM_DNS_CACHE_TTL" default:"60s"`
+	UpstreamHTTP2               bool          `envconfig:"UPSTREAM_HTTP2" default:"false"`
+	UpstreamMaxConcurrent       int           `envconfig:"UPSTREAM_MAX_CONCURRENT" default:"500"`
+	UpstreamConcurrencyTimeout  time.Duration `envconfig:"UPSTREAM_CONCURRENCY_TIMEOUT" default:"5s"`
+	AllowUpstreamOverrideHeader bool          `envconfig:"ALLOW_UPSTREAM_OVERRIDE_HEADER"`
+	UpstreamAllowedHosts        string        `envconfig:"UPSTREAM_ALLOWED_HOSTS"`
+	RouteTimeouts               string        `envconfig:"ROUTE_TIMEOUTS"`
+	ProxyTimeout                time.Duration `envconfig:"PROXY_TIMEOUT" default:"30s"`
+	HealthCheckUpstream         bool          `envconfig:"HEALTH_CHECK_UPSTREAM" default:"true"`
+	HealthUpstreamTimeout       time.Duration `envconfig:"HEALTH_UPSTREAM_TIMEOUT" default:"3s"`
+	HealthTimeout               time.Duration `envconfig:"HEALTH_TIMEOUT" default:"5s"`
+	MirrorEndpoint              string        `envconfig:"MIRROR_ENDPOINT"`
+	MirrorPercentage            float64       `envconfig:"MIRROR_PERCENTAGE" default:"100"`
+	MirrorTimeout               time.Duration `envconfig:"MIRROR_TIMEOUT" default:"2s"`
+	MirrorMaxConcurrent         int           `envconfig:"MIRROR_MAX_CONCURRENT" default:"50"`
+	ProxySecondaryTargets       string        `envconfig:"PROXY_SECONDARY_TARGETS"`
+	ProxySecondaryTimeout       time.Duration `envconfig:"PROXY_SECONDARY_TIMEOUT" default:"2s"`
+	ProxySecondaryMaxConcurrent int           `envconfig:"PROXY_SECONDARY_MAX_CONCURRENT" default:"50"`
+	MetricsPathLabelLimit       int           `envconfig:"METRICS_PATH_LABEL_LIMIT" default:"20"`
+	AdminToken                  string        `envconfig:"ADMIN_TOKEN" sensitive:"true"`
+	PprofEnabled                bool          `envconfig:"PPROF_ENABLED"`
+	PprofPath                   string        `envconfig:"PPROF_PATH" default:"/debug/pprof"`
+	PprofToken                  string        `envconfig:"PPROF_TOKEN" sensitive:"true"`
+	LogFormat                   string        `envconfig:"LOG_FORMAT" default:"default"`
+	LogSampleRate               float64       `envconfig:"LOG_SAMPLE_RATE" default:"1.0"`
+	AccessLogFile               string        `envconfig:"ACCESS_LOG_FILE"`
+	AccessLogFormat             string        `envconfig:"ACCESS_LOG_FORMAT" default:"combined"`
+	LegacyErrorFormat           bool          `envconfig:"LEGACY_ERROR_FORMAT"`
+	ProxyDebugRequests          bool          `envconfig:"PROXY_DEBUG_REQUESTS"`
+	DebugSamplingRate           float64       `envconfig:"DEBUG_SAMPLING_RATE" default:"1.0"`
+	EnableHSTS                  bool          `envconfig:"ENABLE_HSTS"`
+	CSPDirectives               string        `envconfig:"CSP_DIRECTIVES"`
+	CORSAllowOrigins            string        `envconfig:"CORS_ALLOW_ORIGINS" default:"*"`
+	CORSAllowCredentials        bool          `envconfig:"CORS_ALLOW_CREDENTIALS"`
+	CORSPathOverrides           string        `envconfig:"CORS_PATH_OVERRIDES"`
+	CompressEnabled             bool          `envconfig:"COMPRESS_ENABLED"`
+	CompressBrotli              bool          `envconfig:"COMPRESS_BROTLI"`
+	CompressMinSize             int           `envconfig:"COMPRESS_MIN_SIZE" default:"1024"`
+	IPAllowlist                 string        `envconfig:"IP_ALLOWLIST"`
+	IPBlocklist                 string        `envconfig:"IP_BLOCKLIST"`
+	TrustedProxies              string        `envconfig:"TRUSTED_PROXIES"`
+	ConfigFile                  string        `envconfig:"CONFIG_FILE"`
+	Port                        string        `envconfig:"PORT" default:"3000"`
+}
+
+// HeaderMapping maps a request header to the query parameter it is injected as
+type HeaderMapping struct {
+	Header string
+	Param  string
+	// IndexN is the 1-based position of the comma-separated token of the header
+	// value to inject, e.g. an IP of X-Forwarded-For, 0 for the entire value.
+	// It is the 0-based INDEX of INJECT_PARAMS_FROM_REQ_HEADERS plus one.
+	IndexN int
+}
+
+// Value returns the part of the header value to inject,
+// false if the header has no IndexN-th token
+func (m HeaderMapping) Value(header string) (string, bool) {
+	if m.IndexN <= 0 {
+		return header, true
+	}
+
+	tokens := strings.Split(header, ",")
+	if m.IndexN > len(tokens) || header == "" {
+		return "", false
+	}
+
+	return strings.TrimSpace(tokens[m.IndexN-1]), true
+}
+
+// Request headers which must not be injected as query parameters, they carry credentials
+var injectHeadersDenylist = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+	"X-Auth-Token",
+	"X-Api-Key",
+	"X-CSRF-Token",
+}
+
+var paramNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// FieldChange describes a single config field that differs between two configs
+type FieldChange struct {
+	Field    string
+	OldValue interface{}
+	NewValue interface{}
 }
 
+// LoadConfig load config from the environment variables and CONFIG_FILE,
+// errors are logged
 func LoadConfig() Config {
-	config := Config{}
-	envconfig.Process("", &config)
+	config, err := ReadConfig()
+	if err != nil {
+		log.Printf("Failed to load config: %s", err)
+	}
 
 	return config
 }
+
+// ReadConfig read config from the environment variables. When CONFIG_FILE is set,
+// the values in the file are used for the variables which are not set in the environment.
+func ReadConfig() (Config, error) {
+	config := Config{}
+	if err := envconfig.Process("", &config); err != nil {
+		return config, err
+	}
+
+	if config.ConfigFile != "" {
+		if err := applyConfigFile(config.ConfigFile, &config); err != nil {
+			return config, err
+		}
+	}
+	if err := applyLegacyEnv(&config); err != nil {
+		return config, err
+	}
+
+	return config, nil
+}
+
+// The legacy variable names by documented name, envconfig derived them from the
+// field names before the documented names were read
+var legacyEnvNames = map[string]string{
+	"ROUTE_PREFIX":                   "ROUTEPREFIX",
+	"GOOGLE_ORIGIN":                  "GOOGLEORIGIN",
+	"INJECT_PARAMS_FROM_REQ_HEADERS": "INJECTPARAMSFROMREQHEADERS",
+	"SKIP_PARAMS_FROM_REQ_HEADERS":   "SKIPPARAMSFROMREQHEADERS",
+}
+
+// Apply the legacy variables which are set when their documented name is not,
+// they take precedence over the config file like the other variables
+func applyLegacyEnv(config *Config) error {
+	v := reflect.ValueOf(config).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("envconfig")
+		legacy, ok := legacyEnvNames[key]
+		if !ok {
+			continue
+		}
+		value, ok := os.LookupEnv(legacy)
+		if !ok {
+			continue
+		}
+		if _, ok := os.LookupEnv(key); ok {
+			log.Printf("Warning: %s is ignored, %s is set", legacy, key)
+			continue
+		}
+
+		log.Printf("Warning: %s is deprecated, use %s", legacy, key)
+		if err := setConfigField(v.Field(i), value); err != nil {
+			return fmt.Errorf("invalid value %q for %s: %w", value, legacy, err)
+		}
+	}
+
+	return nil
+}
+
+// Apply the values of a YAML config file, whose keys are the environment variable names
+// e.g. ROUTE_PREFIX: /analytics
+func applyConfigFile(path string, config *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	values := map[string]string{}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	v := reflect.ValueOf(config).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("envconfig")
+		value, ok := values[key]
+		if !ok {
+			continue
+		}
+		// Environment variables take precedence
+		if _, ok := os.LookupEnv(key); ok {
+			continue
+		}
+
+		if err := setConfigField(v.Field(i), value); err != nil {
+			return fmt.Errorf("invalid value %q for %s in %s: %w", value, key, path, err)
+		}
+	}
+
+	return nil
+}
+
+func setConfigField(field reflect.Value, value string) error {
+	switch field.Interface().(type) {
+	case string:
+		field.SetString(value)
+	case bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case []string:
+		field.Set(reflect.ValueOf(strings.Split(value, ",")))
+	case time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+
+	return nil
+}
+
+// Validate check the config values
+func (config Config) Validate() error {
+	if _, _, err := config.GetUpstreams(); err != nil {
+		return err
+	}
+	if _, err := config.GetIPList(); err != nil {
+		return err
+	}
+	if _, err := config.GetTrustedProxies(); err != nil {
+		return err
+	}
+	if _, err := config.GetRouteTimeouts(); err != nil {
+		return err
+	}
+	if _, err := config.GetSecondaryTargets(); err != nil {
+		return err
+	}
+	if _, err := config.GetRoutePrefixRegexp(); err != nil {
+		return err
+	}
+	if config.UpstreamMaxConcurrent < 0 {
+		return fmt.Errorf("invalid UPSTREAM_MAX_CONCURRENT %d, expected 0 (unlimited) or more", config.UpstreamMaxConcurrent)
+	}
+	mappings, err := config.GetInjectHeaders()
+	if err != nil {
+		return err
+	}
+	for _, m := range mappings {
+		if err := validateHeaderMapping(m); err != nil {
+			return err
+		}
+	}
+	if _, err := config.GetUpstreamMaxResponseSize(); err != nil {
+		return err
+	}
+	if _, err := config.GetRequestMaxBodySize(); err != nil {
+		return err
+	}
+	if _, err := config.GetUpstreamTLSConfig(); err != nil {
+		return err
+	}
+	for _, header := range config.AddResponseHeaders {
+		if name, _, ok := strings.Cut(header, ":"); !ok || strings.TrimSpace(name) == "" {
+			return fmt.Errorf("invalid ADD_RESPONSE_HEADERS value %q, expected Key:Value", header)
+		}
+	}
+	if config.AllowUpstreamOverrideHeader && len(config.GetUpstreamAllowedHosts()) == 0 {
+		return fmt.Errorf("UPSTREAM_ALLOWED_HOSTS is required when ALLOW_UPSTREAM_OVERRIDE_HEADER=true")
+	}
+	for _, pattern := range config.GetUpstreamAllowedHosts() {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid UPSTREAM_ALLOWED_HOSTS pattern %q", pattern)
+		}
+	}
+	if config.CORSAllowCredentials && hasWildcardOrigin(config.CORSAllowOrigins) {
+		return fmt.Errorf("CORS_ALLOW_CREDENTIALS=true requires explicit CORS_ALLOW_ORIGINS, not *")
+	}
+	if err := validateCORSOrigins(config.CORSAllowOrigins); err != nil {
+		return fmt.Errorf("invalid CORS_ALLOW_ORIGINS: %w", err)
+	}
+	if _, err := config.GetCORSPathOverrides(); err != nil {
+		return err
+	}
+	if config.LogFormat != LogFormatDefault && config.LogFormat != LogFormatCombined {
+		return fmt.Errorf("invalid LOG_FORMAT %q, expected %s or %s", config.LogFormat, LogFormatDefault, LogFormatCombined)
+	}
+	if config.AccessLogFormat != LogFormatCombined && config.AccessLogFormat != LogFormatJSON {
+		return fmt.Errorf("invalid ACCESS_LOG_FORMAT %q, expected %s or %s", config.AccessLogFormat, LogFormatCombined, LogFormatJSON)
+	}
+	if config.LogSampleRate < 0 || config.LogSampleRate > 1 {
+		return fmt.Errorf("invalid LOG_SAMPLE_RATE %v, expected a value between 0.0 and 1.0", config.LogSampleRate)
+	}
+	if config.DebugSamplingRate < 0 || config.DebugSamplingRate > 1 {
+		return fmt.Errorf("invalid DEBUG_SAMPLING_RATE %v, expected a value between 0.0 and 1.0", config.DebugSamplingRate)
+	}
+	if config.PprofEnabled && config.PprofToken == "" {
+		return fmt.Errorf("PPROF_TOKEN is required when PPROF_ENABLED=true")
+	}
+
+	return nil
+}
+
+// GetRoutePrefixRegexp compile ROUTE_PREFIX with ROUTE_PREFIX_REGEX=true, it matches
+// the start of the path followed by "/". It returns nil without ROUTE_PREFIX_REGEX.
+func (config Config) GetRoutePrefixRegexp() (*regexp.Regexp, error) {
+	if !config.RoutePrefixRegex || config.RoutePrefix == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile("^(?:" + config.RoutePrefix + ")/")
+	if err != nil {
+		return nil, fmt.Errorf("invalid ROUTE_PREFIX regular expression %q: %v", config.RoutePrefix, err)
+	}
+	return re, nil
+}
+
+// GetSecondaryTargets parse PROXY_SECONDARY_TARGETS, comma-separated http(s) URLs
+func (config Config) GetSecondaryTargets() ([]string, error) {
+	var targets []string
+	for _, target := range strings.Split(config.ProxySecondaryTargets, ",") {
+		if target = strings.TrimSpace(target); target == "" {
+			continue
+		}
+
+		u, err := url.Parse(target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid PROXY_SECONDARY_TARGETS %q, expected http(s) URLs", target)
+		}
+		targets = append(targets, target)
+	}
+
+	return targets, nil
+}
+
+// GetInjectHeaders parse INJECT_PARAMS_FROM_REQ_HEADERS, a comma-separated list of
+// header names, injected as the parameter of the same name, or [HEADER_NAME]__[PARAM_NAME]
+// e.g. x-email__uip,user-agent__ua, or [HEADER_NAME]__[PARAM_NAME]__[INDEX] to inject
+// the comma-separated token at the 0-based INDEX, e.g. x-forwarded-for__uip__0 for
+// the first one. The mappings store it as the 1-based HeaderMapping.IndexN.
+func (config Config) GetInjectHeaders() ([]HeaderMapping, error) {
+	var mappings []HeaderMapping
+	for _, name := range strings.Split(config.InjectParamsFromReqHeaders, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+
+		parts := strings.Split(name, "__")
+		m := HeaderMapping{Header: parts[0], Param: parts[0]}
+		switch len(parts) {
+		case 1:
+		case 2:
+			m.Param = parts[1]
+		case 3:
+			index, err := strconv.Atoi(parts[2])
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("invalid INJECT_PARAMS_FROM_REQ_HEADERS index in %s, expected a number from 0", name)
+			}
+			m.Param, m.IndexN = parts[1], index+1
+		default:
+			return nil, fmt.Errorf("invalid INJECT_PARAMS_FROM_REQ_HEADERS mapping %s", name)
+		}
+		mappings = append(mappings, m)
+	}
+
+	return mappings, nil
+}
+
+// Reject the mappings forwarding credentials or with invalid names
+func validateHeaderMapping(m HeaderMapping) error {
+	if m.Header == "" || m.Param == "" {
+		return fmt.Errorf("invalid INJECT_PARAMS_FROM_REQ_HEADERS mapping %s__%s, empty header or parameter name", m.Header, m.Param)
+	}
+	for _, header := range injectHeadersDenylist {
+		if strings.EqualFold(m.Header, header) {
+			return fmt.Errorf("INJECT_PARAMS_FROM_REQ_HEADERS can not forward the %s header", m.Header)
+		}
+	}
+	if !paramNameRegexp.MatchString(m.Param) {
+		return fmt.Errorf("invalid INJECT_PARAMS_FROM_REQ_HEADERS parameter name %q, expected [a-zA-Z0-9_-]", m.Param)
+	}
+
+	return nil
+}
+
+// GetUpstreams returns the upstream origins and their weights.
+// GOOGLE_ORIGINS takes precedence over GOOGLE_ORIGIN, weights default to 1.
+func (config Config) GetUpstreams() ([]string, []int, error) {
+	var origins []string
+	for _, origin := range strings.Split(config.GoogleOrigins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	if len(origins) == 0 {
+		origins = []string{config.GoogleOrigin}
+	}
+
+	for _, origin := range origins {
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, nil, fmt.Errorf("invalid upstream origin %q", origin)
+		}
+	}
+
+	weights := make([]int, len(origins))
+	if config.UpstreamWeights == "" {
+		for i := range weights {
+			weights[i] = 1
+		}
+		return origins, weights, nil
+	}
+
+	values := strings.Split(config.UpstreamWeights, ",")
+	if len(values) != len(origins) {
+		return nil, nil, fmt.Errorf("UPSTREAM_WEIGHTS has %d values, expected %d", len(values), len(origins))
+	}
+	for i, value := range values {
+		weight, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || weight <= 0 {
+			return nil, nil, fmt.Errorf("invalid upstream weight %q", value)
+		}
+		weights[i] = weight
+	}
+
+	return origins, weights, nil
+}
+
+// GetUpstreamAllowedHosts returns the host glob patterns of UPSTREAM_ALLOWED_HOSTS
+// e.g. *.google-analytics.com,region1.google-analytics.com
+func (config Config) GetUpstreamAllowedHosts() []string {
+	var patterns []string
+	for _, pattern := range strings.Split(config.UpstreamAllowedHosts, ",") {
+		if pattern = strings.ToLower(strings.TrimSpace(pattern)); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+
+	return patterns
+}
+
+// IsUpstreamHostAllowed reports whether host matches one of UPSTREAM_ALLOWED_HOSTS
+func (config Config) IsUpstreamHostAllowed(host string) bool {
+	host = strings.ToLower(host)
+	for _, pattern := range config.GetUpstreamAllowedHosts() {
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetRouteTimeouts parse ROUTE_TIMEOUTS, a JSON map of path prefix to duration
+// e.g. {"/collect":"1s","/analytics.js":"20s"}
+func (config Config) GetRouteTimeouts() (map[string]time.Duration, error) {
+	timeouts := map[string]time.Duration{}
+	if config.RouteTimeouts == "" {
+		return timeouts, nil
+	}
+
+	values := map[string]string{}
+	if err := json.Unmarshal([]byte(config.RouteTimeouts), &values); err != nil {
+		return nil, fmt.Errorf("invalid ROUTE_TIMEOUTS: %w", err)
+	}
+	for prefix, value := range values {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid ROUTE_TIMEOUTS duration %q for %s", value, prefix)
+		}
+		timeouts[prefix] = timeout
+	}
+
+	return timeouts, nil
+}
+
+// CORSOverride is the CORS config of a path prefix in CORS_PATH_OVERRIDES
+type CORSOverride struct {
+	AllowOrigins     string `json:"allow_origins"`
+	AllowCredentials bool   `json:"allow_credentials"`
+}
+
+// GetCORSPathOverrides parse CORS_PATH_OVERRIDES, a JSON map of path prefix to CORS config
+// e.g. {"/metrics":{"allow_origins":"https://internal.example.com","allow_credentials":false}}
+func (config Config) GetCORSPathOverrides() (map[string]CORSOverride, error) {
+	overrides := map[string]CORSOverride{}
+	if config.CORSPathOverrides == "" {
+		return overrides, nil
+	}
+
+	if err := json.Unmarshal([]byte(config.CORSPathOverrides), &overrides); err != nil {
+		return nil, fmt.Errorf("invalid CORS_PATH_OVERRIDES: %w", err)
+	}
+	for prefix, override := range overrides {
+		if !strings.HasPrefix(prefix, "/") || override.AllowOrigins == "" {
+			return nil, fmt.Errorf("invalid CORS_PATH_OVERRIDES for %q, expected a path prefix and allow_origins", prefix)
+		}
+		if override.AllowCredentials && hasWildcardOrigin(override.AllowOrigins) {
+			return nil, fmt.Errorf("CORS_PATH_OVERRIDES for %s: allow_credentials requires explicit allow_origins, not *", prefix)
+		}
+		if err := validateCORSOrigins(override.AllowOrigins); err != nil {
+			return nil, fmt.Errorf("invalid CORS_PATH_OVERRIDES for %s: %w", prefix, err)
+		}
+	}
+
+	return overrides, nil
+}
+
+// Check the comma-separated CORS origins are scheme://host[:port], as required
+// by the fiber CORS middleware, or a single *. The host may start with a *.
+// subdomain wildcard.
+func validateCORSOrigins(origins string) error {
+	if origins == "" || origins == "*" {
+		return nil
+	}
+
+	for _, origin := range strings.Split(origins, ",") {
+		origin = strings.TrimSpace(origin)
+		u, err := url.Parse(strings.Replace(origin, "://*.", "://", 1))
+		if err != nil || u.Scheme == "" || u.Host == "" || strings.Contains(u.Host, "*") ||
+			(u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+			return fmt.Errorf("origin %q, expected * or scheme://host[:port]", origin)
+		}
+	}
+
+	return nil
+}
+
+// Whether the comma-separated CORS origins allow all origins
+func hasWildcardOrigin(origins string) bool {
+	for _, origin := range strings.Split(origins, ",") {
+		if strings.TrimSpace(origin) == "*" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetUpstreamMaxResponseSize parse UPSTREAM_MAX_RESPONSE_SIZE in bytes, e.g. 10MB, 512KB, 1024
+func (config Config) GetUpstreamMaxResponseSize() (int, error) {
+	size, err := parseByteSize(config.UpstreamMaxResponseSize)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("invalid UPSTREAM_MAX_RESPONSE_SIZE %q", config.UpstreamMaxResponseSize)
+	}
+
+	return size, nil
+}
+
+// GetUpstreamTLSConfig load the client certificate (UPSTREAM_TLS_CERT_FILE, UPSTREAM_TLS_KEY_FILE)
+// and the CA bundle (UPSTREAM_TLS_CA_FILE) used for the upstream connections.
+// It returns nil when none of them is set.
+func (config Config) GetUpstreamTLSConfig() (*tls.Config, error) {
+	if config.UpstreamTLSCertFile == "" && config.UpstreamTLSKeyFile == "" && config.UpstreamTLSCAFile == "" {
+		return nil, nil
+	}
+	if (config.UpstreamTLSCertFile == "") != (config.UpstreamTLSKeyFile == "") {
+		return nil, fmt.Errorf("UPSTREAM_TLS_CERT_FILE and UPSTREAM_TLS_KEY_FILE must be set together")
+	}
+
+	tlsConfig := &tls.Config{}
+	if config.UpstreamTLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.UpstreamTLSCertFile, config.UpstreamTLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if config.UpstreamTLSCAFile != "" {
+		data, err := os.ReadFile(config.UpstreamTLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid UPSTREAM_TLS_CA_FILE: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("invalid UPSTREAM_TLS_CA_FILE: no PEM certificate in %s", config.UpstreamTLSCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
+}
+
+// GetRequestMaxBodySize parse REQUEST_MAX_BODY_SIZE in bytes, e.g. 1MB, 64KB
+func (config Config) GetRequestMaxBodySize() (int, error) {
+	size, err := parseByteSize(config.RequestMaxBodySize)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("invalid REQUEST_MAX_BODY_SIZE %q", config.RequestMaxBodySize)
+	}
+
+	return size, nil
+}
+
+// Room for the request line and the headers besides the URI in the server
+// read buffer, the fiber default buffer size
+const requestHeaderSize = 4096
+
+// GetReadBufferSize returns the size of the server read buffer, which limits the
+// size of the request line and headers, large enough for a MAX_URI_LENGTH URI
+func (config Config) GetReadBufferSize() int {
+	if config.MaxURILength <= 0 {
+		return requestHeaderSize
+	}
+
+	return config.MaxURILength + requestHeaderSize
+}
+
+// Parse a size with an optional B, KB, MB or GB unit (powers of 1024)
+func parseByteSize(value string) (int, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+
+	multiplier := 1
+	for _, unit := range []struct {
+		suffix     string
+		multiplier int
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+
+	return n * multiplier, nil
+}
+
+// GetIPList returns the parsed IP_ALLOWLIST and IP_BLOCKLIST
+func (config Config) GetIPList() (*IPList, error) {
+	return NewIPList(strings.Split(config.IPAllowlist, ","), strings.Split(config.IPBlocklist, ","))
+}
+
+// GetTrustedProxies returns the parsed TRUSTED_PROXIES
+func (config Config) GetTrustedProxies() ([]*net.IPNet, error) {
+	return parseCIDRs(strings.Split(config.TrustedProxies, ","))
+}
+
+// Diff returns the fields that changed from a to b.
+// Values of the sensitive fields are masked, see isSensitiveField.
+func Diff(a, b *Config) []FieldChange {
+	var changes []FieldChange
+
+	va := reflect.ValueOf(a).Elem()
+	vb := reflect.ValueOf(b).Elem()
+	t := va.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		oldValue := va.Field(i).Interface()
+		newValue := vb.Field(i).Interface()
+		if reflect.DeepEqual(oldValue, newValue) {
+			continue
+		}
+
+		if isSensitiveField(field) {
+			oldValue, newValue = "***", "***"
+		}
+		changes = append(changes, FieldChange{Field: field.Name, OldValue: oldValue, NewValue: newValue})
+	}
+
+	return changes
+}
+
+// Diff returns the fields changed in other, formatted as "Field: old → new"
+// to be logged. Values of the sensitive fields are masked.
+func (config Config) Diff(other *Config) []string {
+	var lines []string
+	for _, change := range Diff(&config, other) {
+		lines = append(lines, fmt.Sprintf("%s: %v → %v", change.Field, change.OldValue, change.NewValue))
+	}
+
+	return lines
+}
+
+// Parts of the variable names whose values are redacted by ToRedactedMap
+var sensitiveNameParts = []string{"TOKEN", "PASSWORD", "SECRET", "CREDENTIAL"}
+
+// ToRedactedMap returns the config values by environment variable name, safe to be logged.
+// The values of the sensitive fields are redacted as "***".
+func (config Config) ToRedactedMap() map[string]string {
+	values := map[string]string{}
+
+	v := reflect.ValueOf(config)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := field.Tag.Get("envconfig")
+
+		if isSensitiveField(field) {
+			values[key] = "***"
+			continue
+		}
+
+		switch value := v.Field(i).Interface().(type) {
+		case []string:
+			values[key] = strings.Join(value, ",")
+		default:
+			values[key] = fmt.Sprint(value)
+		}
+	}
+
+	return values
+}
+
+func isSensitiveField(field reflect.StructField) bool {
+	if field.Tag.Get("sensitive") == "true" {
+		return true
+	}
+
+	key := field.Tag.Get("envconfig")
+	for _, part := range sensitiveNameParts {
+		if strings.Contains(key, part) {
+			return true
+		}
+	}
+
+	return false
+}
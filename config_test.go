@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigDiff(t *testing.T) {
+	a := LoadConfig()
+	b := a
+	b.RoutePrefix = "/analytics"
+	b.Port = "8080"
+
+	changes := Diff(&a, &b)
+	assert.Len(t, changes, 2, "should detect exactly two changes")
+
+	assert.Equal(t, "RoutePrefix", changes[0].Field)
+	assert.Equal(t, a.RoutePrefix, changes[0].OldValue)
+	assert.Equal(t, "/analytics", changes[0].NewValue)
+
+	assert.Equal(t, "Port", changes[1].Field)
+	assert.Equal(t, a.Port, changes[1].OldValue)
+	assert.Equal(t, "8080", changes[1].NewValue)
+
+	assert.Empty(t, Diff(&a, &a), "same config should have no changes")
+}
+
+func TestConfigDiffLines(t *testing.T) {
+	a := LoadConfig()
+	b := a
+	b.RoutePrefix = "/analytics"
+	b.MaxURILength = 4096
+	b.AdminToken = "new-secret"
+
+	lines := a.Diff(&b)
+	assert.Equal(t, []string{
+		"RoutePrefix:  → /analytics",
+		"MaxURILength: 8192 → 4096",
+		"AdminToken: *** → ***",
+	}, lines)
+	assert.Empty(t, a.Diff(&a))
+}
+
+func TestConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gaxy.yaml")
+	content := "ROUTE_PREFIX: /analytics\nPORT: 5000\nINJECT_INTEGRITY_HASH: true\nUPSTREAM_CB_TIMEOUT: 1m\n"
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0o644))
+
+	t.Setenv("CONFIG_FILE", path)
+	t.Setenv("PORT", "4000")
+
+	config, err := ReadConfig()
+	assert.Nil(t, err)
+	assert.Nil(t, config.Validate())
+
+	assert.Equal(t, "/analytics", config.RoutePrefix, "value should be read from the file")
+	assert.Equal(t, true, config.InjectIntegrityHash)
+	assert.Equal(t, time.Minute, config.UpstreamCBTimeout)
+	assert.Equal(t, "4000", config.Port, "environment variable should take precedence")
+	assert.Equal(t, "https://www.google-analytics.com", config.GoogleOrigin, "default should be kept")
+}
+
+func TestConfigLegacyEnvNames(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gaxy.yaml")
+	content := "ROUTE_PREFIX: /file\nGOOGLE_ORIGIN: https://file.example.com\n"
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0o644))
+
+	t.Setenv("CONFIG_FILE", path)
+	t.Setenv("ROUTEPREFIX", "/legacy")
+	t.Setenv("GOOGLEORIGIN", "https://legacy.example.com")
+	t.Setenv("GOOGLE_ORIGIN", "https://env.example.com")
+	t.Setenv("INJECTPARAMSFROMREQHEADERS", "user-agent__ua")
+
+	config, err := ReadConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, "/legacy", config.RoutePrefix, "legacy variable should take precedence over the file")
+	assert.Equal(t, "https://env.example.com", config.GoogleOrigin, "documented name should take precedence")
+	assert.Equal(t, "user-agent__ua", config.InjectParamsFromReqHeaders)
+	assert.Equal(t, "", config.SkipParamsFromReqHeaders)
+}
+
+func TestConfigFileInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gaxy.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte("MAX_URI_LENGTH: long\n"), 0o644))
+
+	t.Setenv("CONFIG_FILE", path)
+
+	_, err := ReadConfig()
+	assert.NotNil(t, err)
+}
+
+func TestConfigValidateResponseHeaders(t *testing.T) {
+	config := LoadConfig()
+	assert.Equal(t, []string{"Set-Cookie", "Server"}, config.StripResponseHeaders)
+
+	config.AddResponseHeaders = []string{"X-Robots-Tag:noindex"}
+	assert.Nil(t, config.Validate())
+
+	config.AddResponseHeaders = []string{"X-Robots-Tag"}
+	assert.NotNil(t, config.Validate())
+}
+
+func TestConfigToRedactedMap(t *testing.T) {
+	config := LoadConfig()
+	config.RoutePrefix = "/analytics"
+	config.StripResponseHeaders = []string{"Set-Cookie", "Server"}
+	config.UpstreamCBTimeout = time.Minute
+	config.InjectIntegrityHash = true
+	config.AdminToken = "admin-secret"
+	config.PprofToken = "pprof-secret"
+
+	values := config.ToRedactedMap()
+	assert.Equal(t, "***", values["ADMIN_TOKEN"])
+	assert.Equal(t, "***", values["PPROF_TOKEN"])
+
+	assert.Equal(t, "/analytics", values["ROUTE_PREFIX"])
+	assert.Equal(t, "Set-Cookie,Server", values["STRIP_RESPONSE_HEADERS"])
+	assert.Equal(t, "1m0s", values["UPSTREAM_CB_TIMEOUT"])
+	assert.Equal(t, "true", values["INJECT_INTEGRITY_HASH"])
+	assert.Equal(t, "8192", values["MAX_URI_LENGTH"])
+	assert.Equal(t, config.Port, values["PORT"])
+}
+
+func TestAdminConfigEndpoint(t *testing.T) {
+	config := LoadConfig()
+	config.AdminToken = "admin-secret"
+	app := Setup(config)
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/admin/config", nil), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 401, resp.StatusCode, "should require the admin token")
+
+	req := httptest.NewRequest("GET", "/admin/config", nil)
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	resp, err = app.Test(req, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(body), "admin-secret")
+
+	values := map[string]string{}
+	assert.Nil(t, json.Unmarshal(body, &values))
+	assert.Equal(t, "***", values["ADMIN_TOKEN"])
+	assert.Equal(t, config.GoogleOrigin, values["GOOGLE_ORIGIN"])
+}
+
+func TestConfigUpstreamMaxResponseSize(t *testing.T) {
+	config := LoadConfig()
+
+	size, err := config.GetUpstreamMaxResponseSize()
+	assert.Nil(t, err)
+	assert.Equal(t, 10<<20, size, "default should be 10MB")
+
+	for value, expected := range map[string]int{"1024": 1024, "512KB": 512 << 10, "2 mb": 2 << 20, "1GB": 1 << 30} {
+		config.UpstreamMaxResponseSize = value
+		size, err := config.GetUpstreamMaxResponseSize()
+		assert.Nil(t, err)
+		assert.Equal(t, expected, size)
+	}
+
+	for _, value := range []string{"", "0", "-1MB", "10XB"} {
+		config.UpstreamMaxResponseSize = value
+		assert.NotNilf(t, config.Validate(), "%q should be invalid", value)
+	}
+}
+
+func TestConfigGetInjectHeaders(t *testing.T) {
+	config := LoadConfig()
+	config.InjectParamsFromReqHeaders = "uip, x-email__uip,user-agent__ua,"
+
+	mappings, err := config.GetInjectHeaders()
+	assert.Nil(t, err)
+	assert.Equal(t, []HeaderMapping{
+		{Header: "uip", Param: "uip"},
+		{Header: "x-email", Param: "uip"},
+		{Header: "user-agent", Param: "ua"},
+	}, mappings)
+	assert.Nil(t, config.Validate())
+
+	config.InjectParamsFromReqHeaders = "x-forwarded-for__uip__0,x-forwarded-for__proxy__1,x-forwarded-for__last__2"
+	mappings, err = config.GetInjectHeaders()
+	assert.Nil(t, err)
+	assert.Equal(t, []HeaderMapping{
+		{Header: "x-forwarded-for", Param: "uip", IndexN: 1},
+		{Header: "x-forwarded-for", Param: "proxy", IndexN: 2},
+		{Header: "x-forwarded-for", Param: "last", IndexN: 3},
+	}, mappings)
+	assert.Nil(t, config.Validate())
+
+	for _, value := range []string{"x-forwarded-for__uip__first", "x-forwarded-for__uip__-1", "a__b__0__c"} {
+		config.InjectParamsFromReqHeaders = value
+		assert.NotNilf(t, config.Validate(), "%q should be invalid", value)
+	}
+}
+
+func TestHeaderMappingValue(t *testing.T) {
+	value, ok := HeaderMapping{Header: "X-Email", Param: "uip"}.Value("a@example.com")
+	assert.True(t, ok)
+	assert.Equal(t, "a@example.com", value, "single value")
+
+	xff := HeaderMapping{Header: "X-Forwarded-For", Param: "uip", IndexN: 1}
+	value, ok = xff.Value("1.2.3.4, 10.0.0.1")
+	assert.True(t, ok)
+	assert.Equal(t, "1.2.3.4", value, "index 0")
+
+	xff.IndexN = 2
+	value, ok = xff.Value("1.2.3.4, 10.0.0.1")
+	assert.True(t, ok)
+	assert.Equal(t, "10.0.0.1", value, "index 1")
+
+	xff.IndexN = 3
+	_, ok = xff.Value("1.2.3.4, 10.0.0.1")
+	assert.False(t, ok, "out of range index should be skipped")
+
+	value, ok = xff.Value("1.2.3.4, 10.0.0.1, 10.0.0.2")
+	assert.True(t, ok)
+	assert.Equal(t, "10.0.0.2", value, "last index")
+
+	xff.IndexN = 2
+	value, ok = xff.Value("1.2.3.4, 10.0.0.1, 10.0.0.2")
+	assert.True(t, ok)
+	assert.Equal(t, "10.0.0.1", value, "index 1 of 3")
+
+	_, ok = xff.Value("")
+	assert.False(t, ok, "missing header should be skipped")
+}
+
+func TestValidateHeaderMapping(t *testing.T) {
+	assert.Nil(t, validateHeaderMapping(HeaderMapping{Header: "X-Client-ID", Param: "cid"}))
+	assert.Nil(t, validateHeaderMapping(HeaderMapping{Header: "user-agent", Param: "user-agent"}))
+
+	for _, m := range []HeaderMapping{
+		{Header: "Authorization", Param: "cid"},
+		{Header: "cookie", Param: "cid"},
+		{Header: "X-Auth-Token", Param: "cid"},
+		{Header: "X-Client-ID", Param: "cid&tid=UA-1"},
+		{Header: "X-Client-ID", Param: "c id"},
+		{Header: "", Param: "cid"},
+		{Header: "X-Client-ID", Param: ""},
+	} {
+		assert.NotNilf(t, validateHeaderMapping(m), "%+v should be rejected", m)
+	}
+
+	config := LoadConfig()
+	config.InjectParamsFromReqHeaders = "x-email__uip,Authorization__cid"
+	assert.NotNil(t, config.Validate())
+
+	config.InjectParamsFromReqHeaders = "__cid"
+	assert.NotNil(t, config.Validate())
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Headers whose values are redacted in the debug logs
+var debugRedactedHeaders = []string{
+	fasthttp.HeaderAuthorization,
+	fasthttp.HeaderProxyAuthorization,
+	fasthttp.HeaderCookie,
+	fasthttp.HeaderSetCookie,
+}
+
+// Query parameters whose values are redacted in the debug logs
+var debugRedactedParams = []string{"api_secret"}
+
+// Granularity of DEBUG_SAMPLING_RATE and LOG_SAMPLE_RATE
+const samplingPrecision = 1000000
+
+// Whether the request with this ID is sampled with rate, e.g. DEBUG_SAMPLING_RATE.
+// The decision is a hash of the ID, so it is the same for the same request ID.
+func sampleRequest(id uint64, rate float64) bool {
+	if rate >= 1 {
+		return true
+	}
+	if rate <= 0 {
+		return false
+	}
+
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], id)
+	h := fnv.New64a()
+	h.Write(b[:])
+
+	// The low bits of FNV are the best distributed for sequential IDs
+	return h.Sum64()%samplingPrecision < uint64(rate*samplingPrecision)
+}
+
+// Log the upstream request and response, with PROXY_DEBUG_REQUESTS=true
+func logUpstreamExchange(id uint64, req *fasthttp.Request, resp *fasthttp.Response) {
+	uri := fasthttp.AcquireURI()
+	defer fasthttp.ReleaseURI(uri)
+	req.URI().CopyTo(uri)
+	for _, name := range debugRedactedParams {
+		if uri.QueryArgs().Has(name) {
+			uri.QueryArgs().Set(name, "REDACTED")
+		}
+	}
+
+	log.Printf("[debug %d] upstream request: %s %s %s", id, req.Header.Method(), uri.FullURI(), formatDebugHeaders(req.Header.VisitAll))
+	log.Printf("[debug %d] upstream response: %d %s", id, resp.StatusCode(), formatDebugHeaders(resp.Header.VisitAll))
+}
+
+func formatDebugHeaders(visitAll func(func(key, value []byte))) string {
+	var headers []string
+	visitAll(func(key, value []byte) {
+		v := string(value)
+		for _, name := range debugRedactedHeaders {
+			if strings.EqualFold(string(key), name) {
+				v = "***"
+			}
+		}
+		headers = append(headers, fmt.Sprintf("%s: %q", key, v))
+	})
+
+	return "{" + strings.Join(headers, ", ") + "}"
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShouldDebugRequest(t *testing.T) {
+	assert.True(t, sampleRequest(42, 1))
+	assert.False(t, sampleRequest(42, 0))
+
+	sampled := 0
+	for id := uint64(0); id < 10000; id++ {
+		decision := sampleRequest(id, 0.1)
+		assert.Equal(t, decision, sampleRequest(id, 0.1), "should be deterministic")
+		if decision {
+			sampled++
+		}
+	}
+	assert.InDelta(t, 1000, sampled, 200, "about 10%% of the requests should be sampled")
+}
+
+func captureLog(t *testing.T) *bytes.Buffer {
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	return &output
+}
+
+func TestProxyDebugRequests(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upstream", "yes")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer upstream.Close()
+
+	config := LoadConfig()
+	config.GoogleOrigin = upstream.URL
+	config.ProxyDebugRequests = true
+	config.ForwardCookieNames = "_ga"
+	app := Setup(config)
+
+	output := captureLog(t)
+	req := httptest.NewRequest("GET", "/mp/collect?measurement_id=G-1&api_secret=s3cr3t", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	req.Header.Set("Cookie", "_ga=GA1.1.123")
+	req.Header.Set("X-Custom", "custom")
+	_, err := app.Test(req, -1)
+	assert.Nil(t, err)
+
+	var logs string
+	for _, line := range strings.Split(output.String(), "\n") {
+		if strings.Contains(line, "[debug ") {
+			logs += line + "\n"
+		}
+	}
+	assert.Contains(t, logs, "upstream request: GET "+upstream.URL+"/mp/collect?measurement_id=G-1&api_secret=REDACTED&")
+	assert.Contains(t, logs, `X-Custom: "custom"`)
+	assert.Contains(t, logs, `Authorization: "***"`)
+	assert.Contains(t, logs, `Cookie: "***"`)
+	assert.Contains(t, logs, "upstream response: 204")
+	assert.Contains(t, logs, `X-Upstream: "yes"`)
+	assert.NotContains(t, logs, "s3cr3t")
+	assert.NotContains(t, logs, "Bearer token")
+	assert.NotContains(t, logs, "GA1.1.123")
+
+	// Not sampled
+	config.DebugSamplingRate = 0
+	app = Setup(config)
+	output.Reset()
+	_, err = app.Test(httptest.NewRequest("GET", "/collect", nil), -1)
+	assert.Nil(t, err)
+	assert.NotContains(t, output.String(), "upstream request:")
+	assert.NotContains(t, output.String(), "upstream response:")
+
+	config.DebugSamplingRate = 1.5
+	assert.NotNil(t, config.Validate())
+}
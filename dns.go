@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Maximum number of hosts in the DNS cache, the upstream override header
+// lets clients choose the host
+const dnsCacheMaxEntries = 1024
+
+// Timeout of the background resolution of an expired host
+const dnsRefreshTimeout = 5 * time.Second
+
+// Resolver resolves a host name to its addresses, implemented by net.Resolver
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// DNSCache caches the resolved upstream addresses for a TTL. Expired entries are
+// still served while being resolved again in the background. It is the resolver
+// of the upstream dialer, which does not cache the addresses itself.
+type DNSCache struct {
+	// OnHit and OnMiss are called on each lookup, if set
+	OnHit  func()
+	OnMiss func()
+
+	resolver   Resolver
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*dnsEntry
+}
+
+type dnsEntry struct {
+	addrs      []net.IPAddr
+	expiresAt  time.Time
+	refreshing bool
+}
+
+// NewDNSCache create a cache of the addresses resolved by resolver
+func NewDNSCache(resolver Resolver, ttl time.Duration) *DNSCache {
+	return &DNSCache{
+		resolver:   resolver,
+		ttl:        ttl,
+		maxEntries: dnsCacheMaxEntries,
+		entries:    map[string]*dnsEntry{},
+	}
+}
+
+// LookupIPAddr returns the addresses of host, from the cache if present.
+// It implements fasthttp.Resolver.
+func (d *DNSCache) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+
+	d.mu.Lock()
+	entry, ok := d.entries[host]
+	if ok {
+		if time.Now().After(entry.expiresAt) && !entry.refreshing {
+			entry.refreshing = true
+			go d.refresh(host)
+		}
+		addrs := entry.addrs
+		d.mu.Unlock()
+
+		if d.OnHit != nil {
+			d.OnHit()
+		}
+		return addrs, nil
+	}
+	d.mu.Unlock()
+
+	if d.OnMiss != nil {
+		d.OnMiss()
+	}
+	return d.resolve(ctx, host)
+}
+
+func (d *DNSCache) resolve(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs, err := d.resolver.LookupIPAddr(ctx, host)
+	if err == nil && len(addrs) == 0 {
+		err = errors.New("no address found for " + host)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err != nil {
+		// Keep serving the stale addresses until the next attempt
+		if entry, ok := d.entries[host]; ok {
+			entry.refreshing = false
+		}
+		return nil, err
+	}
+	if _, ok := d.entries[host]; !ok && len(d.entries) >= d.maxEntries {
+		d.evict()
+	}
+	d.entries[host] = &dnsEntry{addrs: addrs, expiresAt: time.Now().Add(d.ttl)}
+
+	return addrs, nil
+}
+
+// Remove the expired entries, or a random one if none is expired. Must be called with mu held.
+func (d *DNSCache) evict() {
+	now := time.Now()
+	for host, entry := range d.entries {
+		if now.After(entry.expiresAt) && !entry.refreshing {
+			delete(d.entries, host)
+		}
+	}
+	if len(d.entries) < d.maxEntries {
+		return
+	}
+
+	for host := range d.entries {
+		delete(d.entries, host)
+		return
+	}
+}
+
+func (d *DNSCache) refresh(host string) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsRefreshTimeout)
+	defer cancel()
+
+	_, _ = d.resolve(ctx, host)
+}
+
+// Create the dialer of the upstream connections, resolving the hosts through
+// cache if not nil. The fasthttp DNS cache is disabled, so without cache the
+// hosts are resolved on every new connection.
+func newUpstreamDialer(cache *DNSCache) *fasthttp.TCPDialer {
+	dialer := &fasthttp.TCPDialer{Concurrency: 1000, DNSCacheDuration: -1}
+	if cache != nil {
+		dialer.Resolver = cache
+	}
+
+	return dialer
+}
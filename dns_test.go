@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type mockResolver struct {
+	calls atomic.Int32
+	fail  atomic.Bool
+}
+
+func (r *mockResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.calls.Add(1)
+	if r.fail.Load() {
+		return nil, errors.New("lookup failed")
+	}
+	return []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}}, nil
+}
+
+func TestDNSCache(t *testing.T) {
+	resolver := &mockResolver{}
+	cache := NewDNSCache(resolver, 100*time.Millisecond)
+	var hits, misses atomic.Int32
+	cache.OnHit = func() { hits.Add(1) }
+	cache.OnMiss = func() { misses.Add(1) }
+
+	// Warm the cache, then look up concurrently
+	_, err := cache.LookupIPAddr(context.Background(), "upstream.test")
+	assert.Nil(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 99; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			addrs, err := cache.LookupIPAddr(context.Background(), "upstream.test")
+			if assert.Nil(t, err) {
+				assert.Equal(t, "127.0.0.1", addrs[0].IP.String())
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), resolver.calls.Load(), "should resolve once per TTL")
+	assert.Equal(t, int32(99), hits.Load())
+	assert.Equal(t, int32(1), misses.Load())
+
+	// Once expired, the stale address is served while resolving again
+	time.Sleep(150 * time.Millisecond)
+	resolver.fail.Store(true)
+	addrs, err := cache.LookupIPAddr(context.Background(), "upstream.test")
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1", addrs[0].IP.String())
+	assert.Eventually(t, func() bool { return resolver.calls.Load() == 2 }, time.Second, 10*time.Millisecond)
+
+	// The failed refresh keeps the stale address, and is retried
+	_, err = cache.LookupIPAddr(context.Background(), "upstream.test")
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool { return resolver.calls.Load() == 3 }, time.Second, 10*time.Millisecond)
+
+	_, err = cache.LookupIPAddr(context.Background(), "other.test")
+	assert.NotNil(t, err, "should fail when the host can not be resolved")
+
+	// IP addresses are not resolved
+	addrs, err = cache.LookupIPAddr(context.Background(), "10.0.0.1")
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.1", addrs[0].IP.String())
+	assert.Equal(t, int32(4), resolver.calls.Load())
+}
+
+func TestDNSCacheMaxEntries(t *testing.T) {
+	resolver := &mockResolver{}
+	cache := NewDNSCache(resolver, time.Minute)
+	cache.maxEntries = 2
+
+	for _, host := range []string{"a.test", "b.test", "c.test", "d.test"} {
+		_, err := cache.LookupIPAddr(context.Background(), host)
+		assert.Nil(t, err)
+	}
+	assert.Len(t, cache.entries, 2, "should evict an entry when full")
+	assert.Contains(t, cache.entries, "d.test", "should keep the last resolved host")
+}
+
+func TestUpstreamDialer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	resolver := &mockResolver{}
+	dialer := newUpstreamDialer(NewDNSCache(resolver, time.Minute))
+	for i := 0; i < 3; i++ {
+		conn, err := dialer.DialTimeout("upstream.test:"+port, time.Second)
+		if assert.Nil(t, err) {
+			conn.Close()
+		}
+	}
+	assert.Equal(t, int32(1), resolver.calls.Load(), "should resolve through the cache")
+
+	_, err = newUpstreamDialer(nil).DialTimeout("upstream.invalid:"+port, time.Second)
+	assert.NotNil(t, err, "should resolve without cache")
+}
+
+func TestDNSCacheMetrics(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+
+	config := LoadConfig()
+	// Use a host name so that it is resolved
+	config.GoogleOrigin = "http://localhost:" + u.Port()
+	app := Setup(config)
+
+	for i := 0; i < 3; i++ {
+		resp, err := app.Test(httptest.NewRequest("GET", "/collect", nil), -1)
+		assert.Nil(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+	}
+
+	metrics := getMetrics(t, app)
+	assert.Contains(t, metrics, "gaxy_dns_cache_misses_total 1")
+	assert.Regexp(t, `gaxy_dns_cache_hits_total \d`, metrics)
+}
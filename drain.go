@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Drainer rejects the new proxied requests once draining, and reports when the
+// in-flight ones are done, so gaxy can shut down without dropping requests
+type Drainer struct {
+	mu       sync.Mutex
+	draining bool
+	inFlight int
+	done     chan struct{}
+}
+
+// NewDrainer create a Drainer which is not draining
+func NewDrainer() *Drainer {
+	return &Drainer{done: make(chan struct{})}
+}
+
+// Drain stop accepting new requests
+func (d *Drainer) Drain() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.draining {
+		d.draining = true
+		d.closeIfDrained()
+	}
+}
+
+// Done is closed when draining and there is no request in flight
+func (d *Drainer) Done() <-chan struct{} {
+	return d.done
+}
+
+// Status returns whether it is draining and the number of requests in flight
+func (d *Drainer) Status() (draining bool, inFlight int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.draining, d.inFlight
+}
+
+// Ready fails while draining, so that no new traffic is routed to gaxy
+func (d *Drainer) Ready(ctx context.Context) error {
+	if draining, _ := d.Status(); draining {
+		return errors.New("draining")
+	}
+
+	return nil
+}
+
+// Handler count the requests in flight, rejects them with 503 while draining
+func (d *Drainer) Handler(c *fiber.Ctx) error {
+	d.mu.Lock()
+	if d.draining {
+		d.mu.Unlock()
+		return fiber.NewError(fiber.StatusServiceUnavailable, "server is draining")
+	}
+	d.inFlight++
+	d.mu.Unlock()
+
+	defer func() {
+		d.mu.Lock()
+		d.inFlight--
+		d.closeIfDrained()
+		d.mu.Unlock()
+	}()
+
+	return c.Next()
+}
+
+// Must be called with d.mu held
+func (d *Drainer) closeIfDrained() {
+	if !d.draining || d.inFlight > 0 {
+		return
+	}
+
+	select {
+	case <-d.done:
+	default:
+		close(d.done)
+	}
+}
+
+// Drain handler
+func drainHandler(c *fiber.Ctx) error {
+	drainer := c.Locals("drainer").(*Drainer)
+	drainer.Drain()
+
+	return drainStatusHandler(c)
+}
+
+// Drain status handler
+func drainStatusHandler(c *fiber.Ctx) error {
+	draining, inFlight := c.Locals("drainer").(*Drainer).Status()
+
+	return c.JSON(fiber.Map{"draining": draining, "in_flight": inFlight})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func adminRequest(method, target string) *http.Request {
+	req := httptest.NewRequest(method, target, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	return req
+}
+
+func TestDrain(t *testing.T) {
+	release := make(chan struct{})
+	var received sync.WaitGroup
+	received.Add(3)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received.Done()
+		<-release
+	}))
+	defer upstream.Close()
+
+	config := LoadConfig()
+	config.GoogleOrigin = upstream.URL
+	config.AdminToken = "secret"
+	drainer := NewDrainer()
+	app := SetupWithStore(NewConfigStore(config), drainer)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	stopped := make(chan struct{})
+	go func() {
+		app.Listener(ln)
+		close(stopped)
+	}()
+	go func() {
+		<-drainer.Done()
+		app.Shutdown()
+	}()
+
+	// Requests in flight
+	var wg sync.WaitGroup
+	statuses := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get("http://" + ln.Addr().String() + "/collect")
+			if assert.Nil(t, err) {
+				statuses <- resp.StatusCode
+			}
+		}()
+	}
+	received.Wait()
+
+	resp, err := app.Test(adminRequest("POST", "/admin/drain"), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	status := map[string]interface{}{}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&status))
+	assert.Equal(t, map[string]interface{}{"draining": true, "in_flight": float64(3)}, status)
+
+	resp, err = app.Test(httptest.NewRequest("GET", "/collect", nil), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 503, resp.StatusCode, "new requests should be rejected")
+
+	resp, err = app.Test(httptest.NewRequest("GET", "/healthz/ready", nil), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 503, resp.StatusCode, "should not be ready while draining")
+
+	select {
+	case <-drainer.Done():
+		t.Fatal("should wait for the requests in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	wg.Wait()
+	close(statuses)
+	for status := range statuses {
+		assert.Equal(t, 200, status, "requests in flight should complete")
+	}
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("server should shut down once drained")
+	}
+	_, inFlight := drainer.Status()
+	assert.Equal(t, 0, inFlight)
+}
+
+func TestDrainStatus(t *testing.T) {
+	config := LoadConfig()
+	config.AdminToken = "secret"
+	app := Setup(config)
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/admin/drain/status", nil), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 401, resp.StatusCode)
+
+	resp, err = app.Test(adminRequest("GET", "/admin/drain/status"), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	status := map[string]interface{}{}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&status))
+	assert.Equal(t, map[string]interface{}{"draining": false, "in_flight": float64(0)}, status)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+)
+
+// Health handler, probe the upstreams unless HEALTH_CHECK_UPSTREAM=false
+func healthHandler(c *fiber.Ctx) error {
+	config := c.Locals("config").(Config)
+
+	upstream := "disabled"
+	if config.HealthCheckUpstream {
+		upstream = "degraded"
+		if probeUpstreams(c.UserContext(), c.Locals("upstreams").(*UpstreamPool), config) {
+			upstream = "ok"
+		}
+	}
+
+	status := "healthy"
+	if upstream == "degraded" {
+		status = "degraded"
+		c.Status(fiber.StatusServiceUnavailable)
+	}
+
+	return c.JSON(fiber.Map{"status": status, "upstream": upstream})
+}
+
+// ReadinessChecker reports whether gaxy is ready to serve traffic,
+// the check should stop when ctx is done
+type ReadinessChecker interface {
+	Ready(ctx context.Context) error
+}
+
+// ReadinessCheckerFunc is a function used as a ReadinessChecker
+type ReadinessCheckerFunc func(ctx context.Context) error
+
+// Ready calls f(ctx)
+func (f ReadinessCheckerFunc) Ready(ctx context.Context) error {
+	return f(ctx)
+}
+
+// Readiness check of the upstreams, unless HEALTH_CHECK_UPSTREAM=false
+type upstreamReadiness struct {
+	store *ConfigStore
+	pool  *UpstreamPool
+}
+
+func (r upstreamReadiness) Ready(ctx context.Context) error {
+	config := r.store.Get()
+	if config.HealthCheckUpstream && !probeUpstreams(ctx, r.pool, config) {
+		return errors.New("no upstream is reachable")
+	}
+
+	return nil
+}
+
+// Liveness handler, returns 200 as long as the server is able to handle requests
+func liveHandler(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{"status": "alive"})
+}
+
+// Readiness handler, returns 503 if any readiness check fails
+func readyHandler(c *fiber.Ctx) error {
+	for _, checker := range c.Locals("readiness").([]ReadinessChecker) {
+		if err := checker.Ready(c.UserContext()); err != nil {
+			return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"status": "not_ready", "error": err.Error()})
+		}
+	}
+
+	return c.JSON(fiber.Map{"status": "ready"})
+}
+
+// Probe the upstreams, reports whether at least one of them is reachable
+// before the deadline of ctx, if any
+func probeUpstreams(ctx context.Context, pool *UpstreamPool, config Config) bool {
+	for _, upstream := range pool.upstreams {
+		if ctx.Err() != nil {
+			return false
+		}
+		if probeUpstream(ctx, pool.Client, upstream.URL.Scheme+"://"+upstream.URL.Host+"/analytics.js", config) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func probeUpstream(ctx context.Context, client *fasthttp.Client, uri string, config Config) bool {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.Header.SetMethod(fasthttp.MethodHead)
+	req.SetRequestURI(uri)
+
+	deadline := time.Now().Add(config.HealthUpstreamTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := client.DoDeadline(req, resp, deadline); err != nil {
+		return false
+	}
+
+	return resp.StatusCode() < fasthttp.StatusInternalServerError
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealth(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "HEAD", r.Method)
+		assert.Equal(t, "/analytics.js", r.URL.Path)
+	}))
+
+	config := LoadConfig()
+	config.GoogleOrigin = upstream.URL
+	app := Setup(config)
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/health", nil), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"status":"healthy","upstream":"ok"}`, string(body))
+
+	upstream.Close()
+
+	resp, err = app.Test(httptest.NewRequest("GET", "/health", nil), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 503, resp.StatusCode, "should be 503 when the upstream is down")
+
+	body, err = ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"status":"degraded","upstream":"degraded"}`, string(body))
+}
+
+func TestHealthWithoutUpstreamCheck(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	upstream.Close()
+
+	config := LoadConfig()
+	config.GoogleOrigin = upstream.URL
+	config.HealthCheckUpstream = false
+	app := Setup(config)
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/health", nil), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"status":"healthy","upstream":"disabled"}`, string(body))
+}
+
+func TestLivenessAndReadiness(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	config := LoadConfig()
+	config.GoogleOrigin = upstream.URL
+
+	var notReady error
+	app := SetupWithStore(NewConfigStore(config), NewDrainer(), ReadinessCheckerFunc(func(ctx context.Context) error {
+		return notReady
+	}))
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/healthz/ready", nil), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	notReady = errors.New("cache is not warmed")
+
+	resp, err = app.Test(httptest.NewRequest("GET", "/healthz/ready", nil), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 503, resp.StatusCode, "should not be ready when a check fails")
+
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"status":"not_ready","error":"cache is not warmed"}`, string(body))
+
+	resp, err = app.Test(httptest.NewRequest("GET", "/healthz/live", nil), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode, "should stay alive when not ready")
+}
+
+func TestReadinessUpstreamDown(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	upstream.Close()
+
+	config := LoadConfig()
+	config.GoogleOrigin = upstream.URL
+	app := Setup(config)
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/healthz/ready", nil), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 503, resp.StatusCode)
+
+	resp, err = app.Test(httptest.NewRequest("GET", "/healthz/live", nil), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
+func TestHealthTimeoutHangingUpstream(t *testing.T) {
+	// Accept the connections and never answer
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	config := LoadConfig()
+	config.GoogleOrigin = "http://" + ln.Addr().String()
+	config.HealthUpstreamTimeout = 2 * time.Second
+	config.HealthTimeout = 200 * time.Millisecond
+	app := Setup(config)
+
+	for _, path := range []string{"/health", "/healthz/ready"} {
+		start := time.Now()
+		resp, err := app.Test(httptest.NewRequest("GET", path, nil), -1)
+		assert.Nil(t, err)
+		assert.Equal(t, 504, resp.StatusCode, path)
+		assert.Less(t, time.Since(start), time.Second, path+" should stop the probe at the handler timeout")
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// HTTP2Client sends the fasthttp requests with net/http, which negotiates
+// HTTP/2 with the upstream. It returns the same errors as fasthttp.Client
+// so both transports are handled identically.
+type HTTP2Client struct {
+	client              *http.Client
+	maxResponseBodySize int
+}
+
+// NewHTTP2Client create a client forcing HTTP/2 over TLS, with the upstream TLS config
+// and dial function (nil for the default ones)
+func NewHTTP2Client(tlsConfig *tls.Config, dial fasthttp.DialFunc, maxResponseBodySize int) *HTTP2Client {
+	transport := &http.Transport{
+		Proxy:              http.ProxyFromEnvironment,
+		TLSClientConfig:    tlsConfig,
+		ForceAttemptHTTP2:  true,
+		DisableCompression: true,
+		IdleConnTimeout:    90 * time.Second,
+	}
+	if dial != nil {
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dial(addr)
+		}
+	}
+
+	return &HTTP2Client{
+		client:              &http.Client{Transport: transport},
+		maxResponseBodySize: maxResponseBodySize,
+	}
+}
+
+// DoDeadline send req and fill resp, until the deadline if not zero
+func (h *HTTP2Client) DoDeadline(req *fasthttp.Request, resp *fasthttp.Response, deadline time.Time) error {
+	ctx := context.Background()
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, string(req.Header.Method()), req.URI().String(), bytes.NewReader(req.Body()))
+	if err != nil {
+		return err
+	}
+	req.Header.VisitAll(func(key, value []byte) {
+		switch string(key) {
+		case fasthttp.HeaderHost:
+			httpReq.Host = string(value)
+		case fasthttp.HeaderContentLength, fasthttp.HeaderConnection:
+		default:
+			httpReq.Header.Add(string(key), string(value))
+		}
+	})
+
+	httpResp, err := h.client.Do(httpReq)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return fasthttp.ErrTimeout
+		}
+		return err
+	}
+	defer httpResp.Body.Close()
+
+	resp.Reset()
+	resp.SetStatusCode(httpResp.StatusCode)
+	for key, values := range httpResp.Header {
+		if key == fasthttp.HeaderContentLength {
+			continue
+		}
+		for _, value := range values {
+			resp.Header.Add(key, value)
+		}
+	}
+
+	body := httpResp.Body
+	if h.maxResponseBodySize > 0 {
+		body = http.MaxBytesReader(nil, httpResp.Body, int64(h.maxResponseBodySize))
+	}
+	content, err := io.ReadAll(body)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return fasthttp.ErrBodyTooLarge
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			return fasthttp.ErrTimeout
+		}
+		return err
+	}
+	resp.SetBody(content)
+
+	return nil
+}
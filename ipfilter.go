@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// IPList is a list of allowed and blocked CIDR ranges
+type IPList struct {
+	allow []*net.IPNet
+	block []*net.IPNet
+}
+
+// NewIPList parse the allowed and blocked CIDR ranges.
+// A single IP address is accepted as a range of one address.
+func NewIPList(allowCIDRs, blockCIDRs []string) (*IPList, error) {
+	allow, err := parseCIDRs(allowCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	block, err := parseCIDRs(blockCIDRs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &IPList{allow: allow, block: block}, nil
+}
+
+// Empty reports whether the list has no ranges
+func (l *IPList) Empty() bool {
+	return len(l.allow) == 0 && len(l.block) == 0
+}
+
+// Check reports whether ip is allowed. When the allowlist is not empty only
+// the IPs in it are allowed, then the IPs in the blocklist are rejected.
+func (l *IPList) Check(ip net.IP) (allowed bool, reason string) {
+	if ip == nil {
+		return false, "invalid IP address"
+	}
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+
+	if len(l.allow) > 0 && !containsIP(l.allow, ip) {
+		return false, fmt.Sprintf("%s is not in the allowlist", ip)
+	}
+	if containsIP(l.block, ip) {
+		return false, fmt.Sprintf("%s is in the blocklist", ip)
+	}
+
+	return true, ""
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", cidr)
+			}
+			if v4 := ip.To4(); v4 != nil {
+				ip = v4
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR range %q", cidr)
+		}
+		// The checked IPs are normalized to IPv4, so are the IPv4-mapped IPv6 ranges
+		if prefix.Addr().Is4In6() {
+			if prefix.Bits() < 96 {
+				return nil, fmt.Errorf("invalid CIDR range %q, IPv4-mapped ranges must be at least /96", cidr)
+			}
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		prefix = prefix.Masked()
+		networks = append(networks, &net.IPNet{
+			IP:   net.IP(prefix.Addr().AsSlice()),
+			Mask: net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen()),
+		})
+	}
+
+	return networks, nil
+}
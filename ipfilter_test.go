@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIPListCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		allow   []string
+		block   []string
+		ip      string
+		allowed bool
+	}{
+		{"empty list", nil, nil, "1.2.3.4", true},
+		{"loopback allowed", []string{"127.0.0.0/8"}, nil, "127.0.0.1", true},
+		{"not in allowlist", []string{"127.0.0.0/8"}, nil, "10.0.0.1", false},
+		{"ipv6 loopback", []string{"::1"}, nil, "::1", true},
+		{"ipv4-mapped ipv6 in ipv4 range", []string{"10.0.0.0/8"}, nil, "::ffff:10.1.2.3", true},
+		{"ipv4-mapped ipv6 blocked", nil, []string{"10.1.2.3"}, "::ffff:10.1.2.3", false},
+		{"ipv4-mapped ipv6 range", []string{"::ffff:10.0.0.0/104"}, nil, "10.1.2.3", true},
+		{"ipv4-mapped ipv6 range and ip", []string{"::ffff:10.0.0.0/104"}, nil, "::ffff:10.1.2.3", true},
+		{"not in ipv4-mapped ipv6 range", []string{"::ffff:10.0.0.0/104"}, nil, "11.1.2.3", false},
+		{"ipv4-mapped ipv6 range blocked", nil, []string{"::ffff:192.168.0.0/112"}, "192.168.1.1", false},
+		{"blocked", nil, []string{"192.168.0.0/16"}, "192.168.1.1", false},
+		{"overlapping, blocked in allowed range", []string{"10.0.0.0/8"}, []string{"10.1.0.0/16"}, "10.1.2.3", false},
+		{"overlapping, allowed outside of blocked range", []string{"10.0.0.0/8"}, []string{"10.1.0.0/16"}, "10.2.2.3", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list, err := NewIPList(tt.allow, tt.block)
+			assert.Nil(t, err)
+
+			allowed, reason := list.Check(net.ParseIP(tt.ip))
+			assert.Equal(t, tt.allowed, allowed)
+			if !allowed {
+				assert.NotEmpty(t, reason)
+			}
+		})
+	}
+}
+
+func TestIPListInvalid(t *testing.T) {
+	_, err := NewIPList([]string{"10.0.0.0/33"}, nil)
+	assert.NotNil(t, err)
+
+	_, err = NewIPList(nil, []string{"not-an-ip"})
+	assert.NotNil(t, err)
+
+	_, err = NewIPList([]string{"::ffff:10.0.0.0/80"}, nil)
+	assert.NotNil(t, err, "ipv4-mapped range shorter than /96 can not be normalized")
+}
+
+func TestIPFilterMiddleware(t *testing.T) {
+	config := LoadConfig()
+	config.IPBlocklist = "0.0.0.0/32"
+	app := Setup(config)
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/ping", nil), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 403, resp.StatusCode)
+
+	config.IPBlocklist = ""
+	config.IPAllowlist = "0.0.0.0/32"
+	app = Setup(config)
+
+	resp, err = app.Test(httptest.NewRequest("GET", "/ping", nil), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/logger"
+)
+
+// Access log formats of LOG_FORMAT and ACCESS_LOG_FORMAT
+const (
+	LogFormatDefault  = "default"
+	LogFormatCombined = "combined"
+	LogFormatJSON     = "json"
+)
+
+// Time format of the Combined Log Format, e.g. 10/Oct/2000:13:55:36 -0700
+const combinedTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// Create the access log middleware writing to output in the LOG_FORMAT format,
+// or ACCESS_LOG_FORMAT when the access log is written to ACCESS_LOG_FILE.
+// With LOG_SAMPLE_RATE < 1 only a fraction of the requests is logged, the
+// errors (4xx, 5xx) are always logged. The decisions are recorded in metrics.
+func newLogger(config Config, output io.Writer, metrics *Metrics) fiber.Handler {
+	loggerConfig := logger.Config{
+		Output: output,
+		Done: func(c *fiber.Ctx, logString []byte) {
+			metrics.RecordLogSample(true)
+		},
+		CustomTags: map[string]logger.LogFunc{
+			logger.TagIP: func(output logger.Buffer, c *fiber.Ctx, _ *logger.Data, _ string) (int, error) {
+				return output.WriteString(getRealIP(c))
+			},
+			"combined": func(output logger.Buffer, c *fiber.Ctx, _ *logger.Data, _ string) (int, error) {
+				return output.WriteString(formatCombined(combinedFields(c)))
+			},
+			"json": func(output logger.Buffer, c *fiber.Ctx, _ *logger.Data, _ string) (int, error) {
+				line, err := json.Marshal(combinedFields(c))
+				if err != nil {
+					return 0, err
+				}
+				return output.Write(line)
+			},
+		},
+	}
+
+	format := config.LogFormat
+	if config.AccessLogFile != "" {
+		format = config.AccessLogFormat
+	}
+	switch format {
+	case LogFormatCombined:
+		loggerConfig.Format = "${combined}\n"
+	case LogFormatJSON:
+		loggerConfig.Format = "${json}\n"
+	}
+	if config.LogSampleRate < 1 {
+		// The entries are written by Done, once the status is known
+		var mu sync.Mutex
+		loggerConfig.Output = io.Discard
+		loggerConfig.Done = func(c *fiber.Ctx, logString []byte) {
+			sampled := c.Response().StatusCode() >= fiber.StatusBadRequest || sampleRequest(c.Context().ID(), config.LogSampleRate)
+			metrics.RecordLogSample(sampled)
+			if !sampled {
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if _, err := output.Write(logString); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to write to log, %v\n", err)
+			}
+		}
+	}
+
+	return logger.New(loggerConfig)
+}
+
+// Fields of the Combined Log Format from the request context:
+//
+//	host        client IP, see getRealIP
+//	ident       always "-", identd is not supported
+//	user        always "-", no authentication
+//	time        time of the log entry
+//	request     request line, c.Method() c.OriginalURL() c.Protocol()
+//	status      response status code
+//	bytes       response body size
+//	referer     Referer request header
+//	user_agent  User-Agent request header
+func combinedFields(c *fiber.Ctx) map[string]interface{} {
+	return map[string]interface{}{
+		"host":       getRealIP(c),
+		"time":       time.Now(),
+		"request":    fmt.Sprintf("%s %s %s", c.Method(), c.OriginalURL(), c.Request().Header.Protocol()),
+		"status":     c.Response().StatusCode(),
+		"bytes":      len(c.Response().Body()),
+		"referer":    c.Get(fiber.HeaderReferer),
+		"user_agent": c.Get(fiber.HeaderUserAgent),
+	}
+}
+
+// Format a log line in Combined Log Format:
+// %h %l %u %t "%r" %>s %b "%{Referer}i" "%{User-agent}i"
+// The missing fields are written as "-".
+func formatCombined(fields map[string]interface{}) string {
+	field := func(name string) string {
+		switch value := fields[name].(type) {
+		case nil:
+			return "-"
+		case string:
+			if value == "" {
+				return "-"
+			}
+			return value
+		case time.Time:
+			return value.Format(combinedTimeFormat)
+		case int:
+			if name == "bytes" && value == 0 {
+				return "-"
+			}
+			return strconv.Itoa(value)
+		default:
+			return fmt.Sprint(value)
+		}
+	}
+	quoted := func(name string) string {
+		return `"` + strings.ReplaceAll(field(name), `"`, `\"`) + `"`
+	}
+
+	return strings.Join([]string{
+		field("host"),
+		field("ident"),
+		field("user"),
+		"[" + field("time") + "]",
+		quoted("request"),
+		field("status"),
+		field("bytes"),
+		quoted("referer"),
+		quoted("user_agent"),
+	}, " ")
+}
+
+// LogFile is an access log file which can be reopened, e.g. after a rotation
+type LogFile struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// OpenLogFile open the log file at path in append mode, creating it if needed
+func OpenLogFile(path string) (*LogFile, error) {
+	l := &LogFile{path: path}
+	if err := l.Reopen(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Write a log entry to the file
+func (l *LogFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.file.Write(p)
+}
+
+// Reopen the file at the same path, the entries written after are in the new file
+func (l *LogFile) Reopen() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file %s: %w", l.path, err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.file = file
+
+	return nil
+}
+
+// Close the file
+func (l *LogFile) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.file.Close()
+}
+
+// Watch reopen the file when one of the signals is received, e.g. SIGUSR1
+// sent by logrotate. It returns a function to stop watching.
+func (l *LogFile) Watch(sig ...os.Signal) func() {
+	ch := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(ch, sig...)
+
+	go func() {
+		for {
+			select {
+			case <-ch:
+				if err := l.Reopen(); err != nil {
+					log.Printf("Failed to reopen the access log: %s", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(ch)
+		close(done)
+	}
+}
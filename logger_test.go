@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// %h %l %u %t "%r" %>s %b "%{Referer}i" "%{User-agent}i"
+var combinedLogRegexp = regexp.MustCompile(`^(\S+) (\S+) (\S+) \[(\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4})\] "([^"]*)" (\d{3}) (\d+|-) "((?:[^"\\]|\\.)*)" "((?:[^"\\]|\\.)*)"$`)
+
+func TestFormatCombined(t *testing.T) {
+	line := formatCombined(map[string]interface{}{
+		"host":       "1.2.3.4",
+		"time":       time.Date(2000, time.October, 10, 13, 55, 36, 0, time.FixedZone("", -7*3600)),
+		"request":    "GET /collect?v=1 HTTP/1.1",
+		"status":     200,
+		"bytes":      2326,
+		"referer":    "https://example.com/",
+		"user_agent": `Mozilla/5.0 "quoted"`,
+	})
+
+	assert.Equal(t, `1.2.3.4 - - [10/Oct/2000:13:55:36 -0700] "GET /collect?v=1 HTTP/1.1" 200 2326 "https://example.com/" "Mozilla/5.0 \"quoted\""`, line)
+	assert.Regexp(t, combinedLogRegexp, line)
+
+	line = formatCombined(map[string]interface{}{"host": "1.2.3.4", "status": 204, "bytes": 0})
+	assert.Equal(t, `1.2.3.4 - - [-] "-" 204 - "-" "-"`, line)
+}
+
+func TestCombinedLogFormat(t *testing.T) {
+	config := LoadConfig()
+	config.LogFormat = LogFormatCombined
+
+	var output bytes.Buffer
+	app := fiber.New()
+	app.Use(newLogger(config, &output, NewMetrics(20)))
+	app.Get("/ping", pingHandler)
+
+	req := httptest.NewRequest("GET", "/ping?v=1", nil)
+	req.Header.Set("Referer", "https://example.com/")
+	req.Header.Set("User-Agent", "gaxy-test")
+	_, err := app.Test(req, -1)
+	assert.Nil(t, err)
+
+	line := strings.TrimSuffix(output.String(), "\n")
+	match := combinedLogRegexp.FindStringSubmatch(line)
+	assert.NotNilf(t, match, "%q should be in Combined Log Format", line)
+	if match == nil {
+		return
+	}
+
+	assert.Equal(t, "0.0.0.0", match[1], "host")
+	assert.Equal(t, "-", match[2], "ident")
+	assert.Equal(t, "-", match[3], "user")
+	assert.Equal(t, "GET /ping?v=1 HTTP/1.1", match[5], "request")
+	assert.Equal(t, "200", match[6], "status")
+	assert.Equal(t, "4", match[7], "bytes")
+	assert.Equal(t, "https://example.com/", match[8], "referer")
+	assert.Equal(t, "gaxy-test", match[9], "user agent")
+}
+
+func TestLogFormatInvalid(t *testing.T) {
+	config := LoadConfig()
+	config.LogFormat = "json"
+	assert.NotNil(t, config.Validate())
+}
+
+func TestLogSampleRate(t *testing.T) {
+	config := LoadConfig()
+	config.LogSampleRate = 0.1
+	assert.Nil(t, config.Validate())
+
+	var output bytes.Buffer
+	metrics := NewMetrics(20)
+	app := fiber.New()
+	app.Use(newLogger(config, &output, metrics))
+	app.Get("/ping", pingHandler)
+	app.Get("/error", func(c *fiber.Ctx) error {
+		return fiber.ErrBadGateway
+	})
+
+	for i := 0; i < 1000; i++ {
+		path := "/ping"
+		if i%10 == 0 {
+			path = "/error"
+		}
+		_, err := app.Test(httptest.NewRequest("GET", path, nil), -1)
+		assert.Nil(t, err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n")
+	errors := 0
+	for _, line := range lines {
+		if strings.Contains(line, "/error") {
+			errors++
+		}
+	}
+	assert.Equal(t, 100, errors, "errors should always be logged")
+
+	// 900 successful requests sampled at 10%: 90 ± 3σ (σ = 9)
+	sampled := len(lines) - errors
+	assert.InDelta(t, 90, sampled, 27)
+
+	assert.Equal(t, uint64(len(lines)), metrics.logSampled.Load())
+	assert.Equal(t, uint64(1000-len(lines)), metrics.logSkipped.Load())
+
+	config.LogSampleRate = 1.5
+	assert.NotNil(t, config.Validate())
+}
+
+func TestAccessLogFile(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	var appLog bytes.Buffer
+	log.SetOutput(&appLog)
+	defer log.SetOutput(os.Stderr)
+
+	path := filepath.Join(t.TempDir(), "access.log")
+	config := LoadConfig()
+	config.GoogleOrigin = upstream.URL
+	config.AccessLogFile = path
+	config.AccessLogFormat = LogFormatJSON
+	assert.Nil(t, config.Validate())
+	app := Setup(config)
+	defer app.Shutdown()
+
+	req := httptest.NewRequest("GET", "/collect?v=1", nil)
+	req.Header.Set("User-Agent", "gaxy-test")
+	_, err := app.Test(req, -1)
+	assert.Nil(t, err)
+
+	content, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	var entry map[string]interface{}
+	assert.Nil(t, json.Unmarshal(content, &entry), "access log should contain one JSON entry")
+	assert.Equal(t, "GET /collect?v=1 HTTP/1.1", entry["request"])
+	assert.Equal(t, float64(200), entry["status"])
+	assert.Equal(t, "gaxy-test", entry["user_agent"])
+	assert.NotContains(t, string(content), "making request to", "app log should not be in the access log")
+
+	assert.Contains(t, appLog.String(), "making request to")
+	assert.NotContains(t, appLog.String(), `"user_agent":`, "access log should not be in the app log")
+
+	// Reopen after a rotation
+	assert.Nil(t, os.Rename(path, path+".1"))
+	assert.Nil(t, syscall.Kill(os.Getpid(), syscall.SIGUSR1))
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}, time.Second, 10*time.Millisecond, "log file should be reopened on SIGUSR1")
+
+	_, err = app.Test(httptest.NewRequest("GET", "/collect?v=2", nil), -1)
+	assert.Nil(t, err)
+
+	content, err = os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Contains(t, string(content), "/collect?v=2")
+	assert.NotContains(t, string(content), "/collect?v=1")
+
+	config.AccessLogFormat = LogFormatDefault
+	assert.NotNil(t, config.Validate())
+}
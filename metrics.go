@@ -0,0 +1,372 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Circuit breaker events recorded by Metrics
+const (
+	CircuitEventOpen          = "open"
+	CircuitEventHalfOpenProbe = "half_open_probe"
+	CircuitEventClose         = "close"
+)
+
+// Path label of the requests whose path exceeds the path label limit
+const otherPathLabel = "other"
+
+// Metrics collects the gaxy metrics, exported in Prometheus text format.
+// The mutex guards the map-based counters, the scalar ones are atomic
+// so the hot path does not contend on the lock.
+type Metrics struct {
+	mu             sync.Mutex
+	circuitOpens   map[string]uint64
+	halfOpenProbes map[string]uint64
+	requestsByPath map[string]map[string]uint64
+	pathLabelLimit int
+
+	responsesTooLarge map[string]uint64
+	secondaryErrors   map[string]uint64
+	bodiesTooLarge    atomic.Uint64
+	dnsCacheHits      atomic.Uint64
+	dnsCacheMisses    atomic.Uint64
+	logSampled        atomic.Uint64
+	logSkipped        atomic.Uint64
+	mirrorRequests    atomic.Uint64
+	mirrorErrors      atomic.Uint64
+
+	upstreamConcurrencyBlocked atomic.Uint64
+
+	lastResetTime time.Time
+}
+
+// NewMetrics create an empty Metrics, which records up to pathLabelLimit
+// distinct request paths, the other ones are recorded as "other"
+func NewMetrics(pathLabelLimit int) *Metrics {
+	return &Metrics{
+		circuitOpens:   map[string]uint64{},
+		halfOpenProbes: map[string]uint64{},
+		requestsByPath: map[string]map[string]uint64{},
+		pathLabelLimit: pathLabelLimit,
+
+		responsesTooLarge: map[string]uint64{},
+		secondaryErrors:   map[string]uint64{},
+	}
+}
+
+// RecordBodyTooLarge record a request rejected for exceeding REQUEST_MAX_BODY_SIZE
+func (m *Metrics) RecordBodyTooLarge() {
+	m.bodiesTooLarge.Add(1)
+}
+
+// RecordDNSCacheLookup record a lookup of the upstream DNS cache
+func (m *Metrics) RecordDNSCacheLookup(hit bool) {
+	if hit {
+		m.dnsCacheHits.Add(1)
+	} else {
+		m.dnsCacheMisses.Add(1)
+	}
+}
+
+// RecordLogSample record whether the access log entry of a request was written with LOG_SAMPLE_RATE
+func (m *Metrics) RecordLogSample(sampled bool) {
+	if sampled {
+		m.logSampled.Add(1)
+	} else {
+		m.logSkipped.Add(1)
+	}
+}
+
+// RecordMirrorRequest record a copy of a request sent to MIRROR_ENDPOINT
+func (m *Metrics) RecordMirrorRequest() {
+	m.mirrorRequests.Add(1)
+}
+
+// RecordMirrorError record a failed copy of a request to MIRROR_ENDPOINT
+func (m *Metrics) RecordMirrorError() {
+	m.mirrorErrors.Add(1)
+}
+
+// RecordSecondaryError record a failed request to a PROXY_SECONDARY_TARGETS backend
+func (m *Metrics) RecordSecondaryError(backend string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.secondaryErrors[backend]++
+}
+
+// RecordUpstreamConcurrencyBlocked record a request waiting for an UPSTREAM_MAX_CONCURRENT slot
+func (m *Metrics) RecordUpstreamConcurrencyBlocked() {
+	m.upstreamConcurrencyBlocked.Add(1)
+}
+
+// RecordResponseTooLarge record a response of backend rejected for exceeding UPSTREAM_MAX_RESPONSE_SIZE
+func (m *Metrics) RecordResponseTooLarge(backend string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.responsesTooLarge[backend]++
+}
+
+// Reset zero all the counters, e.g. between load tests
+func (m *Metrics) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.circuitOpens = map[string]uint64{}
+	m.halfOpenProbes = map[string]uint64{}
+	m.requestsByPath = map[string]map[string]uint64{}
+	m.responsesTooLarge = map[string]uint64{}
+	m.secondaryErrors = map[string]uint64{}
+	m.bodiesTooLarge.Store(0)
+	m.dnsCacheHits.Store(0)
+	m.dnsCacheMisses.Store(0)
+	m.logSampled.Store(0)
+	m.logSkipped.Store(0)
+	m.mirrorRequests.Store(0)
+	m.mirrorErrors.Store(0)
+	m.upstreamConcurrencyBlocked.Store(0)
+	m.lastResetTime = time.Now()
+}
+
+// RecordRequest record a request to path answered with status
+func (m *Metrics) RecordRequest(path string, status int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	if _, ok := m.requestsByPath[path]; !ok {
+		if len(m.requestsByPath) >= m.pathLabelLimit {
+			path = otherPathLabel
+		}
+		if _, ok := m.requestsByPath[path]; !ok {
+			// The path may be backed by a reused buffer, e.g. fiber's c.Path()
+			path = strings.Clone(path)
+			m.requestsByPath[path] = map[string]uint64{}
+		}
+	}
+	m.requestsByPath[path][strconv.Itoa(status)]++
+}
+
+// RecordCircuitEvent record a state transition of the circuit breaker of backend
+func (m *Metrics) RecordCircuitEvent(backend, event string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch event {
+	case CircuitEventOpen:
+		m.circuitOpens[backend]++
+	case CircuitEventHalfOpenProbe:
+		m.halfOpenProbes[backend]++
+	}
+}
+
+// Export the metrics in Prometheus text format
+func (m *Metrics) Export(pool *UpstreamPool) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b strings.Builder
+
+	b.WriteString("# HELP gaxy_info Build information of gaxy.\n")
+	b.WriteString("# TYPE gaxy_info gauge\n")
+	fmt.Fprintf(&b, "gaxy_info{version=%q,build_time=%q,git_commit=%q} 1\n", Version, BuildTime, GitCommit)
+
+	b.WriteString("# HELP gaxy_upstream_circuit_state Current state of the upstream circuit breaker.\n")
+	b.WriteString("# TYPE gaxy_upstream_circuit_state gauge\n")
+	for _, upstream := range pool.upstreams {
+		current := upstream.Breaker.State()
+		for _, state := range []CircuitState{CircuitClosed, CircuitOpen, CircuitHalfOpen} {
+			value := 0
+			if state == current {
+				value = 1
+			}
+			fmt.Fprintf(&b, "gaxy_upstream_circuit_state{backend=%q,state=%q} %d\n", upstream.URL.Host, state, value)
+		}
+	}
+
+	writeCounter(&b, "gaxy_upstream_circuit_opens_total", "Number of times the upstream circuit breaker opened.", m.circuitOpens)
+	writeCounter(&b, "gaxy_upstream_circuit_half_open_probes_total", "Number of half-open probes sent to the upstream.", m.halfOpenProbes)
+	writeCounter(&b, "gaxy_upstream_response_truncated_total", "Number of upstream responses rejected for exceeding the maximum size.", m.responsesTooLarge)
+	writeCounter(&b, "gaxy_secondary_errors_total", "Number of failed requests to the secondary targets.", m.secondaryErrors)
+
+	b.WriteString("# HELP gaxy_mirror_requests_total Number of requests copied to the mirror endpoint.\n")
+	b.WriteString("# TYPE gaxy_mirror_requests_total counter\n")
+	fmt.Fprintf(&b, "gaxy_mirror_requests_total %d\n", m.mirrorRequests.Load())
+	b.WriteString("# HELP gaxy_mirror_errors_total Number of failed copies to the mirror endpoint.\n")
+	b.WriteString("# TYPE gaxy_mirror_errors_total counter\n")
+	fmt.Fprintf(&b, "gaxy_mirror_errors_total %d\n", m.mirrorErrors.Load())
+
+	b.WriteString("# HELP gaxy_upstream_concurrency_blocked_total Number of requests which waited for an upstream concurrency slot.\n")
+	b.WriteString("# TYPE gaxy_upstream_concurrency_blocked_total counter\n")
+	fmt.Fprintf(&b, "gaxy_upstream_concurrency_blocked_total %d\n", m.upstreamConcurrencyBlocked.Load())
+
+	b.WriteString("# HELP gaxy_requests_body_too_large_total Number of requests rejected for exceeding the maximum body size.\n")
+	b.WriteString("# TYPE gaxy_requests_body_too_large_total counter\n")
+	fmt.Fprintf(&b, "gaxy_requests_body_too_large_total %d\n", m.bodiesTooLarge.Load())
+
+	b.WriteString("# HELP gaxy_dns_cache_hits_total Number of upstream DNS lookups served from the cache.\n")
+	b.WriteString("# TYPE gaxy_dns_cache_hits_total counter\n")
+	fmt.Fprintf(&b, "gaxy_dns_cache_hits_total %d\n", m.dnsCacheHits.Load())
+	b.WriteString("# HELP gaxy_dns_cache_misses_total Number of upstream DNS lookups not in the cache.\n")
+	b.WriteString("# TYPE gaxy_dns_cache_misses_total counter\n")
+	fmt.Fprintf(&b, "gaxy_dns_cache_misses_total %d\n", m.dnsCacheMisses.Load())
+
+	b.WriteString("# HELP gaxy_log_sampled_total Number of access log entries written.\n")
+	b.WriteString("# TYPE gaxy_log_sampled_total counter\n")
+	fmt.Fprintf(&b, "gaxy_log_sampled_total %d\n", m.logSampled.Load())
+	b.WriteString("# HELP gaxy_log_skipped_total Number of access log entries skipped by LOG_SAMPLE_RATE.\n")
+	b.WriteString("# TYPE gaxy_log_skipped_total counter\n")
+	fmt.Fprintf(&b, "gaxy_log_skipped_total %d\n", m.logSkipped.Load())
+
+	b.WriteString("# HELP gaxy_requests_by_path_total Number of requests by path and status code.\n")
+	b.WriteString("# TYPE gaxy_requests_by_path_total counter\n")
+	for _, path := range sortedKeys(m.requestsByPath) {
+		statuses := m.requestsByPath[path]
+		for _, status := range sortedKeys(statuses) {
+			fmt.Fprintf(&b, "gaxy_requests_by_path_total{path=%q,status=%q} %d\n", path, status, statuses[status])
+		}
+	}
+
+	if !m.lastResetTime.IsZero() {
+		b.WriteString("# HELP gaxy_metrics_last_reset_timestamp_seconds Time of the last reset of the metrics.\n")
+		b.WriteString("# TYPE gaxy_metrics_last_reset_timestamp_seconds gauge\n")
+		fmt.Fprintf(&b, "gaxy_metrics_last_reset_timestamp_seconds %d\n", m.lastResetTime.Unix())
+	}
+
+	return b.String()
+}
+
+// Version of the JSON export format
+const metricsJSONVersion = 1
+
+// JSON export of the metrics, the fields mirror the Prometheus metrics
+type metricsJSON struct {
+	Version int `json:"version"`
+	Metrics struct {
+		Info                             map[string]string            `json:"info"`
+		UpstreamCircuitState             map[string]string            `json:"upstream_circuit_state"`
+		UpstreamCircuitOpensTotal        map[string]uint64            `json:"upstream_circuit_opens_total"`
+		UpstreamCircuitHalfOpenProbes    map[string]uint64            `json:"upstream_circuit_half_open_probes_total"`
+		UpstreamResponseTruncatedTotal   map[string]uint64            `json:"upstream_response_truncated_total"`
+		SecondaryErrorsTotal             map[string]uint64            `json:"secondary_errors_total"`
+		MirrorRequestsTotal              uint64                       `json:"mirror_requests_total"`
+		MirrorErrorsTotal                uint64                       `json:"mirror_errors_total"`
+		UpstreamConcurrencyBlockedTotal  uint64                       `json:"upstream_concurrency_blocked_total"`
+		DNSCacheHitsTotal                uint64                       `json:"dns_cache_hits_total"`
+		DNSCacheMissesTotal              uint64                       `json:"dns_cache_misses_total"`
+		LogSampledTotal                  uint64                       `json:"log_sampled_total"`
+		LogSkippedTotal                  uint64                       `json:"log_skipped_total"`
+		RequestsBodyTooLargeTotal        uint64                       `json:"requests_body_too_large_total"`
+		RequestsByPathTotal              map[string]map[string]uint64 `json:"requests_by_path_total"`
+		MetricsLastResetTimestampSeconds int64                        `json:"metrics_last_reset_timestamp_seconds,omitempty"`
+	} `json:"metrics"`
+}
+
+// ExportJSON export the metrics as a versioned JSON object, {"version":1,"metrics":{...}}
+func (m *Metrics) ExportJSON(pool *UpstreamPool) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := metricsJSON{Version: metricsJSONVersion}
+	out.Metrics.Info = map[string]string{"version": Version, "build_time": BuildTime, "git_commit": GitCommit}
+	out.Metrics.UpstreamCircuitState = map[string]string{}
+	for _, upstream := range pool.upstreams {
+		out.Metrics.UpstreamCircuitState[upstream.URL.Host] = upstream.Breaker.State().String()
+	}
+	out.Metrics.UpstreamCircuitOpensTotal = m.circuitOpens
+	out.Metrics.UpstreamCircuitHalfOpenProbes = m.halfOpenProbes
+	out.Metrics.UpstreamResponseTruncatedTotal = m.responsesTooLarge
+	out.Metrics.SecondaryErrorsTotal = m.secondaryErrors
+	out.Metrics.MirrorRequestsTotal = m.mirrorRequests.Load()
+	out.Metrics.MirrorErrorsTotal = m.mirrorErrors.Load()
+	out.Metrics.UpstreamConcurrencyBlockedTotal = m.upstreamConcurrencyBlocked.Load()
+	out.Metrics.DNSCacheHitsTotal = m.dnsCacheHits.Load()
+	out.Metrics.DNSCacheMissesTotal = m.dnsCacheMisses.Load()
+	out.Metrics.LogSampledTotal = m.logSampled.Load()
+	out.Metrics.LogSkippedTotal = m.logSkipped.Load()
+	out.Metrics.RequestsBodyTooLargeTotal = m.bodiesTooLarge.Load()
+	out.Metrics.RequestsByPathTotal = m.requestsByPath
+	if !m.lastResetTime.IsZero() {
+		out.Metrics.MetricsLastResetTimestampSeconds = m.lastResetTime.Unix()
+	}
+
+	// Marshal while holding the lock, the maps are not copied
+	return json.Marshal(out)
+}
+
+func writeCounter(b *strings.Builder, name, help string, values map[string]uint64) {
+	fmt.Fprintf(b, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(b, "# TYPE %s counter\n", name)
+
+	for _, backend := range sortedKeys(values) {
+		fmt.Fprintf(b, "%s{backend=%q} %d\n", name, backend, values[backend])
+	}
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// Record the path and status code of every request
+func requestMetrics(metrics *Metrics) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		err := c.Next()
+
+		status := c.Response().StatusCode()
+		if err != nil {
+			// The error handler sets the status code after the middlewares
+			status = fiber.StatusInternalServerError
+			var e *fiber.Error
+			if errors.As(err, &e) {
+				status = e.Code
+			}
+		}
+		metrics.RecordRequest(c.Path(), status)
+
+		return err
+	}
+}
+
+// Metrics handler
+func metricsHandler(c *fiber.Ctx) error {
+	metrics := c.Locals("metrics").(*Metrics)
+	pool := c.Locals("upstreams").(*UpstreamPool)
+
+	// Prometheus text format by default, JSON when preferred by the client
+	if c.Accepts(fiber.MIMETextPlain, fiber.MIMEApplicationJSON) == fiber.MIMEApplicationJSON {
+		body, err := metrics.ExportJSON(pool)
+		if err != nil {
+			return err
+		}
+		c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		return c.Send(body)
+	}
+
+	c.Set(fiber.HeaderContentType, "text/plain; version=0.0.4; charset=utf-8")
+	return c.SendString(metrics.Export(pool))
+}
+
+// Reset metrics handler
+func resetMetricsHandler(c *fiber.Ctx) error {
+	c.Locals("metrics").(*Metrics).Reset()
+
+	return c.JSON(fiber.Map{"reset": true})
+}
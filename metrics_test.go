@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func getMetrics(t *testing.T, app *fiber.App) string {
+	resp, err := app.Test(httptest.NewRequest("GET", "/metrics", nil), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	return string(body)
+}
+
+func TestCircuitMetrics(t *testing.T) {
+	var healthy atomic.Bool
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer upstream.Close()
+
+	config := LoadConfig()
+	config.GoogleOrigin = upstream.URL
+	config.UpstreamCBThreshold = 5
+	config.UpstreamCBTimeout = 50 * time.Millisecond
+	app := Setup(config)
+
+	u, _ := url.Parse(upstream.URL)
+	backend := `backend="` + u.Host + `"`
+
+	assert.Contains(t, getMetrics(t, app), `gaxy_upstream_circuit_state{`+backend+`,state="closed"} 1`)
+
+	for i := 0; i < 5; i++ {
+		_, err := app.Test(httptest.NewRequest("GET", "/collect", nil), -1)
+		assert.Nil(t, err)
+	}
+
+	metrics := getMetrics(t, app)
+	assert.Contains(t, metrics, `gaxy_upstream_circuit_state{`+backend+`,state="open"} 1`)
+	assert.Contains(t, metrics, `gaxy_upstream_circuit_state{`+backend+`,state="closed"} 0`)
+	assert.Contains(t, metrics, `gaxy_upstream_circuit_opens_total{`+backend+`} 1`)
+
+	healthy.Store(true)
+	time.Sleep(60 * time.Millisecond)
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/collect", nil), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	metrics = getMetrics(t, app)
+	assert.Contains(t, metrics, `gaxy_upstream_circuit_state{`+backend+`,state="closed"} 1`)
+	assert.Contains(t, metrics, `gaxy_upstream_circuit_half_open_probes_total{`+backend+`} 1`)
+}
+
+func TestRequestsByPathMetrics(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/error" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer upstream.Close()
+
+	config := LoadConfig()
+	config.GoogleOrigin = upstream.URL
+	app := Setup(config)
+
+	for _, target := range []string{"/collect?v=1", "/collect?v=2", "/error"} {
+		_, err := app.Test(httptest.NewRequest("GET", target, nil), -1)
+		assert.Nil(t, err)
+	}
+
+	metrics := getMetrics(t, app)
+	assert.Contains(t, metrics, `gaxy_requests_by_path_total{path="/collect",status="200"} 2`)
+	assert.Contains(t, metrics, `gaxy_requests_by_path_total{path="/error",status="502"} 1`)
+}
+
+func TestRequestsByPathLabelLimit(t *testing.T) {
+	metrics := NewMetrics(2)
+	metrics.RecordRequest("/collect?v=1", 200)
+	metrics.RecordRequest("/analytics.js", 200)
+	metrics.RecordRequest("/a", 404)
+	metrics.RecordRequest("/b", 404)
+	metrics.RecordRequest("/collect", 200)
+
+	pool, err := NewUpstreamPool(LoadConfig())
+	assert.Nil(t, err)
+
+	exported := metrics.Export(pool)
+	assert.Contains(t, exported, `gaxy_requests_by_path_total{path="/collect",status="200"} 2`)
+	assert.Contains(t, exported, `gaxy_requests_by_path_total{path="/analytics.js",status="200"} 1`)
+	assert.Contains(t, exported, `gaxy_requests_by_path_total{path="other",status="404"} 2`)
+	assert.NotContains(t, exported, `path="/a"`)
+}
+
+func TestMetricsReset(t *testing.T) {
+	config := LoadConfig()
+	config.AdminToken = "secret"
+	app := Setup(config)
+
+	_, err := app.Test(httptest.NewRequest("GET", "/ping", nil), -1)
+	assert.Nil(t, err)
+	assert.Contains(t, getMetrics(t, app), `gaxy_requests_by_path_total{path="/ping",status="200"} 1`)
+	assert.NotContains(t, getMetrics(t, app), "gaxy_metrics_last_reset_timestamp_seconds")
+
+	resp, err := app.Test(httptest.NewRequest("POST", "/admin/metrics/reset", nil), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 401, resp.StatusCode, "should require the admin token")
+
+	req := httptest.NewRequest("POST", "/admin/metrics/reset", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err = app.Test(req, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	metrics := getMetrics(t, app)
+	assert.NotContains(t, metrics, `path="/ping"`)
+	assert.Contains(t, metrics, "gaxy_metrics_last_reset_timestamp_seconds ")
+}
+
+func TestMetricsResetConcurrent(t *testing.T) {
+	metrics := NewMetrics(20)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				metrics.RecordRequest("/collect", 200)
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		metrics.Reset()
+	}
+	wg.Wait()
+
+	metrics.Reset()
+	metrics.RecordRequest("/collect", 200)
+
+	pool, err := NewUpstreamPool(LoadConfig())
+	assert.Nil(t, err)
+	assert.Contains(t, metrics.Export(pool), `gaxy_requests_by_path_total{path="/collect",status="200"} 1`)
+}
+
+func TestMetricsExportJSON(t *testing.T) {
+	config := LoadConfig()
+	pool, err := NewUpstreamPool(config)
+	assert.Nil(t, err)
+
+	metrics := NewMetrics(20)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				metrics.RecordRequest("/collect", 200)
+				metrics.RecordDNSCacheLookup(j%2 == 0)
+			}
+		}()
+	}
+	metrics.RecordCircuitEvent("www.google-analytics.com", CircuitEventOpen)
+	metrics.RecordBodyTooLarge()
+	wg.Wait()
+
+	body, err := metrics.ExportJSON(pool)
+	assert.Nil(t, err)
+
+	var exported struct {
+		Version int                        `json:"version"`
+		Metrics map[string]json.RawMessage `json:"metrics"`
+	}
+	assert.Nil(t, json.Unmarshal(body, &exported))
+	assert.Equal(t, 1, exported.Version)
+
+	// Compare to the fields read directly
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	assert.JSONEq(t, `{"/collect":{"200":1000}}`, string(exported.Metrics["requests_by_path_total"]))
+	assert.Equal(t, uint64(1000), metrics.requestsByPath["/collect"]["200"])
+	assert.JSONEq(t, `500`, string(exported.Metrics["dns_cache_hits_total"]))
+	assert.Equal(t, uint64(500), metrics.dnsCacheHits.Load())
+	assert.JSONEq(t, `500`, string(exported.Metrics["dns_cache_misses_total"]))
+	assert.JSONEq(t, `1`, string(exported.Metrics["requests_body_too_large_total"]))
+	assert.JSONEq(t, `{"www.google-analytics.com":1}`, string(exported.Metrics["upstream_circuit_opens_total"]))
+	assert.JSONEq(t, `{"www.google-analytics.com":"closed"}`, string(exported.Metrics["upstream_circuit_state"]))
+	assert.NotContains(t, exported.Metrics, "metrics_last_reset_timestamp_seconds")
+}
+
+func TestMetricsContentNegotiation(t *testing.T) {
+	app := Setup(LoadConfig())
+
+	for accept, contentType := range map[string]string{
+		"":                 "text/plain; version=0.0.4; charset=utf-8",
+		"text/plain":       "text/plain; version=0.0.4; charset=utf-8",
+		"*/*":              "text/plain; version=0.0.4; charset=utf-8",
+		"application/json": "application/json",
+	} {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := app.Test(req, -1)
+		assert.Nil(t, err)
+		assert.Equalf(t, contentType, resp.Header.Get("Content-Type"), "Accept: %s", accept)
+
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		if contentType == "application/json" {
+			assert.True(t, strings.HasPrefix(string(body), `{"version":1,"metrics":{`))
+		} else {
+			assert.Contains(t, string(body), "# TYPE gaxy_requests_by_path_total counter")
+		}
+	}
+}
+
+func BenchmarkMetricsRecordRequest(b *testing.B) {
+	metrics := NewMetrics(20)
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			metrics.RecordRequest("/collect", 200)
+		}
+	})
+}
+
+func BenchmarkMetricsRecordDNSCacheLookup(b *testing.B) {
+	metrics := NewMetrics(20)
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			metrics.RecordDNSCacheLookup(true)
+		}
+	})
+}
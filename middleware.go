@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/cors"
+	"github.com/valyala/fasthttp"
+)
+
+// Security headers, only set when enabled in the config
+func securityHeaders(c *fiber.Ctx) error {
+	config := c.Locals("config").(Config)
+
+	if config.EnableHSTS {
+		c.Set(fiber.HeaderStrictTransportSecurity, "max-age=31536000; includeSubDomains")
+	}
+	if csp := buildCSP(config.CSPDirectives); csp != "" {
+		c.Set(fiber.HeaderContentSecurityPolicy, csp)
+	}
+
+	return c.Next()
+}
+
+// Normalize the CSP directives separated by semicolon
+// e.g. "default-src 'self' ;; script-src 'self'" -> "default-src 'self'; script-src 'self'"
+func buildCSP(directives string) string {
+	var parts []string
+	for _, directive := range strings.Split(directives, ";") {
+		if directive = strings.Join(strings.Fields(directive), " "); directive != "" {
+			parts = append(parts, directive)
+		}
+	}
+
+	return strings.Join(parts, "; ")
+}
+
+// Resolve the client IP into the "real_ip" local. When the request comes from a
+// trusted proxy, X-Forwarded-For is walked from right to left skipping the trusted
+// proxies, the first untrusted address is the client.
+func realIP(trusted []*net.IPNet) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		c.Locals("real_ip", resolveRealIP(c.Context().RemoteIP(), c.Get(fiber.HeaderXForwardedFor), trusted))
+		return c.Next()
+	}
+}
+
+func resolveRealIP(remoteIP net.IP, forwardedFor string, trusted []*net.IPNet) string {
+	ip := remoteIP
+	if !containsIP(trusted, ip) || forwardedFor == "" {
+		return ip.String()
+	}
+
+	hops := strings.Split(forwardedFor, ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			// Can not trust anything left of a malformed entry
+			break
+		}
+		ip = hop
+		if !containsIP(trusted, hop) {
+			break
+		}
+	}
+
+	return ip.String()
+}
+
+// Client IP resolved by the realIP middleware
+func getRealIP(c *fiber.Ctx) string {
+	if ip, ok := c.Locals("real_ip").(string); ok {
+		return ip
+	}
+
+	return c.IP()
+}
+
+// Reject the requests from IPs which are not allowed by the list
+func ipFilter(list *IPList) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		ip := getRealIP(c)
+		if allowed, reason := list.Check(net.ParseIP(ip)); !allowed {
+			log.Printf("Rejected request from %s: %s", ip, reason)
+			return fiber.ErrForbidden
+		}
+
+		return c.Next()
+	}
+}
+
+// Apply the CORS config of the most specific CORS_PATH_OVERRIDES prefix,
+// or CORS_ALLOW_ORIGINS and CORS_ALLOW_CREDENTIALS for the other paths
+func corsByPath(config Config, overrides map[string]CORSOverride, routePrefixRegexp *regexp.Regexp) fiber.Handler {
+	defaultHandler := cors.New(cors.Config{
+		AllowOrigins:     config.CORSAllowOrigins,
+		AllowCredentials: config.CORSAllowCredentials,
+	})
+	if len(overrides) == 0 {
+		return defaultHandler
+	}
+
+	handlers := map[string]fiber.Handler{}
+	for prefix, override := range overrides {
+		handlers[prefix] = cors.New(cors.Config{
+			AllowOrigins:     override.AllowOrigins,
+			AllowCredentials: override.AllowCredentials,
+		})
+	}
+
+	return func(c *fiber.Ctx) error {
+		// Registered before the routePrefixRegex middleware, trim the prefix here
+		path := trimRoutePrefix(c.Path(), config)
+		if routePrefixRegexp != nil {
+			path = strings.TrimPrefix(path, strings.TrimSuffix(routePrefixRegexp.FindString(path), "/"))
+		}
+
+		handler, matched := defaultHandler, -1
+		for prefix, h := range handlers {
+			if strings.HasPrefix(path, prefix) && len(prefix) > matched {
+				handler, matched = h, len(prefix)
+			}
+		}
+
+		return handler(c)
+	}
+}
+
+// Route the requests whose path matches the ROUTE_PREFIX_REGEX regular expression
+// as if they had no prefix, fiber can not route a regular expression prefix.
+// The matched prefix is stored in c.Locals("route_prefix").
+func routePrefixRegex(re *regexp.Regexp) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if prefix := strings.TrimSuffix(re.FindString(c.Path()), "/"); prefix != "" {
+			// c.Path() is overwritten below, copy the prefix
+			c.Locals("route_prefix", strings.Clone(prefix))
+			c.Path(strings.TrimPrefix(c.Path(), prefix))
+		}
+
+		return c.Next()
+	}
+}
+
+// Set a deadline on the request context, using the timeout of the
+// most specific path prefix in ROUTE_TIMEOUTS
+func routeTimeout(timeouts map[string]time.Duration) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		config := c.Locals("config").(Config)
+		path := trimRoutePrefix(c.Path(), config)
+
+		var timeout time.Duration
+		matched := -1
+		for prefix, d := range timeouts {
+			if strings.HasPrefix(path, prefix) && len(prefix) > matched {
+				timeout, matched = d, len(prefix)
+			}
+		}
+		if matched < 0 {
+			return c.Next()
+		}
+
+		ctx, cancel := context.WithTimeout(c.UserContext(), timeout)
+		defer cancel()
+		c.SetUserContext(ctx)
+
+		return c.Next()
+	}
+}
+
+// Fail the request with a 504 and message when the next handlers are not done within d.
+// The deadline is set on c.UserContext() and only bounds the work watching it, e.g. the
+// upstream request and the health probes: the handlers run inline as fiber.Ctx is not
+// safe for concurrent use, a handler ignoring the context gets its 504 once it returns.
+func handlerTimeout(d time.Duration, message string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if d <= 0 {
+			return c.Next()
+		}
+
+		ctx, cancel := context.WithTimeout(c.UserContext(), d)
+		defer cancel()
+		c.SetUserContext(ctx)
+
+		err := c.Next()
+		// The clients of fasthttp may give up right before ctx is done
+		if deadline, _ := ctx.Deadline(); !time.Now().Before(deadline) {
+			return fiber.NewError(fiber.StatusGatewayTimeout, message)
+		}
+		return err
+	}
+}
+
+// Compress the response bodies with gzip, or brotli if enabled, when accepted by the client.
+// The bodies already encoded, e.g. passed through from the upstream, are kept as is.
+func compress(c *fiber.Ctx) error {
+	if err := c.Next(); err != nil {
+		return err
+	}
+
+	config := c.Locals("config").(Config)
+	if !config.CompressEnabled {
+		return nil
+	}
+
+	resp := c.Response()
+	body := resp.Body()
+	if len(resp.Header.ContentEncoding()) > 0 || len(body) < config.CompressMinSize {
+		return nil
+	}
+
+	switch {
+	case config.CompressBrotli && c.Request().Header.HasAcceptEncoding("br"):
+		resp.SetBodyRaw(fasthttp.AppendBrotliBytes(nil, body))
+		resp.Header.SetContentEncoding("br")
+	case c.Request().Header.HasAcceptEncoding("gzip"):
+		resp.SetBodyRaw(fasthttp.AppendGzipBytes(nil, body))
+		resp.Header.SetContentEncoding("gzip")
+	default:
+		return nil
+	}
+	c.Vary(fiber.HeaderAcceptEncoding)
+
+	return nil
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func TestSecurityHeadersDisabled(t *testing.T) {
+	config := LoadConfig()
+	app := Setup(config)
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/ping", nil), -1)
+	assert.Nil(t, err)
+	assert.Empty(t, resp.Header.Get("Strict-Transport-Security"))
+	assert.Empty(t, resp.Header.Get("Content-Security-Policy"))
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	tests := []struct {
+		directives string
+		expected   string
+	}{
+		{"default-src 'self'", "default-src 'self'"},
+		{
+			"default-src 'self'; script-src 'self' https://www.google-analytics.com",
+			"default-src 'self'; script-src 'self' https://www.google-analytics.com",
+		},
+		{
+			"  default-src  'none' ;; script-src 'sha256-B2yPHKaXnvFWtRChIbabYmUBFZdVfKKXHbWtWidDVF8=' ;",
+			"default-src 'none'; script-src 'sha256-B2yPHKaXnvFWtRChIbabYmUBFZdVfKKXHbWtWidDVF8='",
+		},
+		{"img-src https://*.example.com data:; report-uri /csp?a=1&b=2", "img-src https://*.example.com data:; report-uri /csp?a=1&b=2"},
+	}
+
+	for _, tt := range tests {
+		config := LoadConfig()
+		config.EnableHSTS = true
+		config.CSPDirectives = tt.directives
+		app := Setup(config)
+
+		resp, err := app.Test(httptest.NewRequest("GET", "/ping", nil), -1)
+		assert.Nil(t, err)
+		assert.Equal(t, "max-age=31536000; includeSubDomains", resp.Header.Get("Strict-Transport-Security"))
+		assert.Equal(t, tt.expected, resp.Header.Get("Content-Security-Policy"))
+	}
+}
+
+func TestRouteTimeouts(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+	}))
+	defer upstream.Close()
+
+	config := LoadConfig()
+	config.GoogleOrigin = upstream.URL
+	config.RouteTimeouts = `{"/":"5s","/collect":"100ms","/analytics.js":"2s"}`
+	assert.Nil(t, config.Validate())
+	app := Setup(config)
+
+	start := time.Now()
+	resp, err := app.Test(httptest.NewRequest("GET", "/collect", nil), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 504, resp.StatusCode, "should time out on the short route")
+	assert.Less(t, time.Since(start), 250*time.Millisecond)
+
+	resp, err = app.Test(httptest.NewRequest("GET", "/analytics.js", nil), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode, "should succeed on the long route")
+}
+
+func TestRouteTimeoutsInvalid(t *testing.T) {
+	config := LoadConfig()
+	config.RouteTimeouts = `{"/collect":"soon"}`
+	assert.NotNil(t, config.Validate())
+
+	config.RouteTimeouts = `not json`
+	assert.NotNil(t, config.Validate())
+}
+
+func TestCompress(t *testing.T) {
+	script := strings.Repeat("console.log('gaxy');", 100)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small.js":
+			w.Header().Set("Content-Type", "text/javascript")
+			w.Write([]byte("1"))
+		case "/collect":
+			w.Header().Set("Content-Type", "image/gif")
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(fasthttp.AppendGzipBytes(nil, []byte(script)))
+		default:
+			w.Header().Set("Content-Type", "text/javascript")
+			w.Write([]byte(script))
+		}
+	}))
+	defer upstream.Close()
+
+	config := LoadConfig()
+	config.GoogleOrigin = upstream.URL
+	config.CompressEnabled = true
+	config.CompressBrotli = true
+
+	get := func(app *fiber.App, path, acceptEncoding string) (*http.Response, []byte) {
+		req := httptest.NewRequest("GET", path, nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		resp, err := app.Test(req, -1)
+		assert.Nil(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		return resp, body
+	}
+
+	app := Setup(config)
+
+	resp, body := get(app, "/analytics.js", "gzip")
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+	decoded, err := fasthttp.AppendGunzipBytes(nil, body)
+	assert.Nil(t, err)
+	assert.Equal(t, script, string(decoded))
+
+	resp, body = get(app, "/analytics.js", "gzip, br")
+	assert.Equal(t, "br", resp.Header.Get("Content-Encoding"))
+	decoded, err = fasthttp.AppendUnbrotliBytes(nil, body)
+	assert.Nil(t, err)
+	assert.Equal(t, script, string(decoded))
+
+	resp, body = get(app, "/analytics.js", "")
+	assert.Empty(t, resp.Header.Get("Content-Encoding"), "should not compress when not accepted")
+	assert.Empty(t, resp.Header.Get("Vary"))
+	assert.Equal(t, script, string(body))
+
+	resp, body = get(app, "/small.js", "gzip")
+	assert.Empty(t, resp.Header.Get("Content-Encoding"), "should not compress below COMPRESS_MIN_SIZE")
+	assert.Equal(t, "1", string(body))
+
+	resp, body = get(app, "/collect", "gzip")
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	decoded, err = fasthttp.AppendGunzipBytes(nil, body)
+	assert.Nil(t, err)
+	assert.Equal(t, script, string(decoded), "should not compress twice")
+
+	config.CompressBrotli = false
+	resp, _ = get(Setup(config), "/analytics.js", "br")
+	assert.Empty(t, resp.Header.Get("Content-Encoding"), "brotli should be disabled")
+
+	config.CompressEnabled = false
+	resp, _ = get(Setup(config), "/analytics.js", "gzip")
+	assert.Empty(t, resp.Header.Get("Content-Encoding"), "compression should be disabled")
+}
+
+func TestResolveRealIP(t *testing.T) {
+	trusted, err := parseCIDRs([]string{"10.0.0.0/8", "192.168.1.1"})
+	assert.Nil(t, err)
+
+	cases := []struct {
+		remote       string
+		forwardedFor string
+		expected     string
+	}{
+		// Untrusted remote, X-Forwarded-For is ignored
+		{"1.2.3.4", "9.9.9.9", "1.2.3.4"},
+		{"10.0.0.1", "", "10.0.0.1"},
+		{"10.0.0.1", "1.2.3.4", "1.2.3.4"},
+		// Spoofed left-most entry is skipped
+		{"10.0.0.1", "9.9.9.9, 1.2.3.4", "1.2.3.4"},
+		{"10.0.0.1", "9.9.9.9, 1.2.3.4, 192.168.1.1, 10.0.0.2", "1.2.3.4"},
+		// Only trusted proxies, the left-most one is the best guess
+		{"10.0.0.1", "10.0.0.3, 10.0.0.2", "10.0.0.3"},
+		{"10.0.0.1", "1.2.3.4, not-an-ip, 10.0.0.2", "10.0.0.2"},
+		{"10.0.0.1", "2001:db8::1", "2001:db8::1"},
+	}
+	for _, tc := range cases {
+		actual := resolveRealIP(net.ParseIP(tc.remote), tc.forwardedFor, trusted)
+		assert.Equalf(t, tc.expected, actual, "remote %s, X-Forwarded-For %q", tc.remote, tc.forwardedFor)
+	}
+
+	assert.Equal(t, "10.0.0.1", resolveRealIP(net.ParseIP("10.0.0.1"), "1.2.3.4", nil), "no trusted proxies")
+}
+
+func TestTrustedProxies(t *testing.T) {
+	var upstreamIP string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamIP = r.URL.Query().Get("uip")
+	}))
+	defer upstream.Close()
+
+	config := LoadConfig()
+	config.GoogleOrigin = upstream.URL
+	config.IPBlocklist = "9.9.9.9"
+
+	send := func(app *fiber.App, forwardedFor string) int {
+		req := httptest.NewRequest("GET", "/collect", nil)
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		resp, err := app.Test(req, -1)
+		assert.Nil(t, err)
+		return resp.StatusCode
+	}
+
+	// Behind an untrusted proxy, the remote address is the client
+	app := Setup(config)
+	assert.Equal(t, 200, send(app, "1.2.3.4"))
+	assert.Equal(t, "0.0.0.0", upstreamIP)
+
+	// The test requests come from 0.0.0.0
+	config.TrustedProxies = "0.0.0.0,10.0.0.0/8"
+	app = Setup(config)
+	assert.Equal(t, 200, send(app, "9.9.9.9, 1.2.3.4, 10.0.0.1"), "spoofed IP should not be used")
+	assert.Equal(t, "1.2.3.4", upstreamIP)
+	assert.Equal(t, 403, send(app, "1.2.3.4, 9.9.9.9"), "real IP should be checked by the blocklist")
+
+	config.TrustedProxies = "not-a-cidr"
+	assert.NotNil(t, config.Validate())
+}
+
+func TestCORSAllowOrigins(t *testing.T) {
+	get := func(app *fiber.App, origin string) *http.Response {
+		req := httptest.NewRequest("GET", "/ping", nil)
+		req.Header.Set("Origin", origin)
+		resp, err := app.Test(req, -1)
+		assert.Nil(t, err)
+		return resp
+	}
+
+	config := LoadConfig()
+	resp := get(Setup(config), "https://example.com")
+	assert.Equal(t, "*", resp.Header.Get("Access-Control-Allow-Origin"), "should allow all origins by default")
+	assert.Empty(t, resp.Header.Get("Access-Control-Allow-Credentials"))
+
+	config.CORSAllowOrigins = "https://example.com"
+	resp = get(Setup(config), "https://example.com")
+	assert.Equal(t, "https://example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+
+	config.CORSAllowOrigins = "https://example.com, https://shop.example.com"
+	config.CORSAllowCredentials = true
+	assert.Nil(t, config.Validate())
+	app := Setup(config)
+
+	resp = get(app, "https://shop.example.com")
+	assert.Equal(t, "https://shop.example.com", resp.Header.Get("Access-Control-Allow-Origin"), "should reflect the matching origin")
+	assert.Equal(t, "true", resp.Header.Get("Access-Control-Allow-Credentials"))
+
+	resp = get(app, "https://evil.com")
+	assert.Empty(t, resp.Header.Get("Access-Control-Allow-Origin"), "should not allow other origins")
+
+	config.CORSAllowOrigins = "*"
+	assert.NotNil(t, config.Validate(), "credentials should not be allowed with wildcard origin")
+
+	config.CORSAllowCredentials = false
+	for _, origins := range []string{"https://*.example.com", "http://localhost:3000", "https://example.com/"} {
+		config.CORSAllowOrigins = origins
+		assert.Nilf(t, config.Validate(), "%q should be valid", origins)
+		assert.NotPanics(t, func() { Setup(config) })
+	}
+	for _, origins := range []string{"example.com", "localhost:3000", "https://example.com/path", "https://example.com,", "https://example.com, *", "https://*"} {
+		config.CORSAllowOrigins = origins
+		assert.NotNilf(t, config.Validate(), "%q should be invalid", origins)
+	}
+}
+
+func TestCORSPathOverrides(t *testing.T) {
+	config := LoadConfig()
+	config.CORSPathOverrides = `{"/metrics":{"allow_origins":"https://internal.example.com"}}`
+	assert.Nil(t, config.Validate())
+	app := Setup(config)
+
+	req := httptest.NewRequest("OPTIONS", "/collect", nil)
+	req.Header.Set("Origin", "https://example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	resp, err := app.Test(req, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, "*", resp.Header.Get("Access-Control-Allow-Origin"), "/collect should keep the default CORS config")
+
+	req = httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Origin", "https://example.com")
+	resp, err = app.Test(req, -1)
+	assert.Nil(t, err)
+	assert.Empty(t, resp.Header.Get("Access-Control-Allow-Origin"), "/metrics should not allow other origins")
+
+	req = httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Origin", "https://internal.example.com")
+	resp, err = app.Test(req, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://internal.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+
+	// With ROUTE_PREFIX_REGEX, the overrides match the path without the prefix
+	config.RoutePrefix = `/(analytics|stats)-v[0-9]+`
+	config.RoutePrefixRegex = true
+	assert.Nil(t, config.Validate())
+	app = Setup(config)
+
+	req = httptest.NewRequest("GET", "/stats-v2/metrics", nil)
+	req.Header.Set("Origin", "https://example.com")
+	resp, err = app.Test(req, -1)
+	assert.Nil(t, err)
+	assert.Empty(t, resp.Header.Get("Access-Control-Allow-Origin"), "prefixed /metrics should not allow other origins")
+
+	req = httptest.NewRequest("GET", "/stats-v2/metrics", nil)
+	req.Header.Set("Origin", "https://internal.example.com")
+	resp, err = app.Test(req, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://internal.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+
+	req = httptest.NewRequest("OPTIONS", "/analytics-v1/collect", nil)
+	req.Header.Set("Origin", "https://example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	resp, err = app.Test(req, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, "*", resp.Header.Get("Access-Control-Allow-Origin"), "prefixed /collect should keep the default CORS config")
+
+	for _, value := range []string{
+		`{"/metrics":{"allow_origins":"*","allow_credentials":true}}`,
+		`{"metrics":{"allow_origins":"https://internal.example.com"}}`,
+		`{"/metrics":{}}`,
+		`{"/metrics":{"allow_origins":"internal.example.com"}}`,
+		`{"/metrics":{"allow_origins":"https://internal.example.com/metrics"}}`,
+		`/metrics`,
+	} {
+		config.CORSPathOverrides = value
+		assert.NotNilf(t, config.Validate(), "%q should be invalid", value)
+	}
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	config := LoadConfig()
+	app := fiber.New(fiber.Config{
+		ErrorHandler: func(c *fiber.Ctx, err error) error {
+			return writeError(c, err, config)
+		},
+	})
+	slow := func(c *fiber.Ctx) error {
+		select {
+		case <-time.After(200 * time.Millisecond):
+			return c.SendString("done")
+		case <-c.UserContext().Done():
+			return c.UserContext().Err()
+		}
+	}
+	app.Get("/slow", handlerTimeout(100*time.Millisecond, "took too long"), slow)
+	app.Get("/fast", handlerTimeout(100*time.Millisecond, "took too long"), func(c *fiber.Ctx) error {
+		return c.SendString("done")
+	})
+	app.Get("/disabled", handlerTimeout(0, "took too long"), slow)
+	app.Get("/blocking", handlerTimeout(100*time.Millisecond, "took too long"), func(c *fiber.Ctx) error {
+		time.Sleep(200 * time.Millisecond)
+		return c.SendString("done")
+	})
+
+	start := time.Now()
+	resp, err := app.Test(httptest.NewRequest("GET", "/slow", nil), -1)
+	assert.Nil(t, err)
+	assert.Less(t, time.Since(start), 150*time.Millisecond, "should not wait for the handler")
+	assert.Equal(t, 504, resp.StatusCode)
+	assert.Equal(t, problemContentType, resp.Header.Get("Content-Type"))
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Contains(t, string(body), `"detail":"took too long"`)
+
+	resp, err = app.Test(httptest.NewRequest("GET", "/fast", nil), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	resp, err = app.Test(httptest.NewRequest("GET", "/disabled", nil), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode, "zero should disable the timeout")
+
+	// Only the work watching the context is bounded
+	start = time.Now()
+	resp, err = app.Test(httptest.NewRequest("GET", "/blocking", nil), -1)
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond, "should wait for the handler ignoring the context")
+	assert.Equal(t, 504, resp.StatusCode, "should still time out once the handler returns")
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+)
+
+// Mirror sends a copy of the proxied requests to MIRROR_ENDPOINT.
+// The copies are fire-and-forget, their errors do not affect the response.
+type Mirror struct {
+	client   *fasthttp.Client
+	endpoint string
+	sem      chan struct{}
+
+	// OnSend is called with the endpoint of every copy sent,
+	// OnError with the endpoint of every failed copy
+	OnSend  func(endpoint string)
+	OnError func(endpoint string)
+}
+
+// NewMirror create a mirror for MIRROR_ENDPOINT, at most MIRROR_MAX_CONCURRENT
+// copies are in flight, the other ones are dropped. The copies and their
+// failures are recorded in metrics.
+func NewMirror(config Config, metrics *Metrics) *Mirror {
+	mirror := newMirror(config.MirrorEndpoint, config.MirrorMaxConcurrent)
+	mirror.OnSend = func(string) { metrics.RecordMirrorRequest() }
+	mirror.OnError = func(string) { metrics.RecordMirrorError() }
+
+	return mirror
+}
+
+func newMirror(endpoint string, maxConcurrent int) *Mirror {
+	return &Mirror{
+		client:   &fasthttp.Client{},
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		sem:      make(chan struct{}, maxConcurrent),
+	}
+}
+
+// Handler mirror MIRROR_PERCENTAGE percent of the requests
+func (m *Mirror) Handler(c *fiber.Ctx) error {
+	config := c.Locals("config").(Config)
+
+	if rand.Float64()*100 < config.MirrorPercentage {
+		m.Send(c, m.endpoint, config.MirrorTimeout)
+	}
+
+	return c.Next()
+}
+
+// Send a copy of the request to endpoint in the background,
+// the copy is dropped if too many copies are in flight
+func (m *Mirror) Send(c *fiber.Ctx, endpoint string, timeout time.Duration) {
+	config := c.Locals("config").(Config)
+
+	select {
+	case m.sem <- struct{}{}:
+	default:
+		// Too many mirrored requests in flight
+		return
+	}
+
+	req := fasthttp.AcquireRequest()
+	c.Request().CopyTo(req)
+	req.SetRequestURI(strings.TrimSuffix(endpoint, "/") + trimRoutePrefix(string(c.Request().RequestURI()), config))
+	if m.OnSend != nil {
+		m.OnSend(endpoint)
+	}
+
+	go func() {
+		resp := fasthttp.AcquireResponse()
+
+		defer func() { <-m.sem }()
+		defer fasthttp.ReleaseRequest(req)
+		defer fasthttp.ReleaseResponse(resp)
+
+		if err := m.client.DoTimeout(req, resp, timeout); err != nil {
+			log.Printf("Mirror request to %s failed: %s", req.URI().FullURI(), err)
+			if m.OnError != nil {
+				m.OnError(endpoint)
+			}
+		}
+	}()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMirror(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("primary"))
+	}))
+	defer upstream.Close()
+
+	mirrored := make(chan string, 1)
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrored <- r.URL.RequestURI()
+	}))
+	defer mirror.Close()
+
+	config := LoadConfig()
+	config.GoogleOrigin = upstream.URL
+	config.MirrorEndpoint = mirror.URL
+	config.RoutePrefix = "/prefix"
+	app := Setup(config)
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/prefix/collect?tid=UA-1", nil), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	select {
+	case uri := <-mirrored:
+		assert.Equal(t, "/collect?tid=UA-1", uri)
+	case <-time.After(time.Second):
+		t.Fatal("request should be mirrored")
+	}
+	metrics := getMetrics(t, app)
+	assert.Contains(t, metrics, "gaxy_mirror_requests_total 1\n")
+	assert.Contains(t, metrics, "gaxy_mirror_errors_total 0\n")
+}
+
+func TestMirrorDown(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("primary"))
+	}))
+	defer upstream.Close()
+
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	mirror.Close()
+
+	config := LoadConfig()
+	config.GoogleOrigin = upstream.URL
+	config.MirrorEndpoint = mirror.URL
+	app := Setup(config)
+
+	for i := 0; i < 5; i++ {
+		resp, err := app.Test(httptest.NewRequest("GET", "/collect", nil), -1)
+		assert.Nil(t, err)
+		assert.Equal(t, 200, resp.StatusCode, "primary response should not be affected")
+
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		assert.Equal(t, "primary", string(body))
+	}
+
+	assert.Contains(t, getMetrics(t, app), "gaxy_mirror_requests_total 5\n")
+	assert.Eventually(t, func() bool {
+		return strings.Contains(getMetrics(t, app), "gaxy_mirror_errors_total 5\n")
+	}, time.Second, 10*time.Millisecond, "failed copies should be counted")
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+)
+
+// Register the net/http/pprof handlers at path, e.g. /debug/pprof/heap
+func registerPprof(router fiber.Router, path string) {
+	router.Get(path, pprofAuth, pprofHandler)
+	router.Get(path+"/:name", pprofAuth, pprofHandler)
+}
+
+// Profiling endpoints are protected by PPROF_TOKEN bearer auth
+func pprofAuth(c *fiber.Ctx) error {
+	config := c.Locals("config").(Config)
+
+	expected := []byte("Bearer " + config.PprofToken)
+	if config.PprofToken == "" || subtle.ConstantTimeCompare([]byte(c.Get(fiber.HeaderAuthorization)), expected) != 1 {
+		return fiber.ErrUnauthorized
+	}
+
+	return c.Next()
+}
+
+// Dispatch to the pprof handler by name, as net/http/pprof only
+// resolves the profile names under /debug/pprof/
+func pprofHandler(c *fiber.Ctx) error {
+	var handler http.Handler
+	switch name := c.Params("name"); name {
+	case "":
+		handler = http.HandlerFunc(pprof.Index)
+	case "cmdline":
+		handler = http.HandlerFunc(pprof.Cmdline)
+	case "profile":
+		handler = http.HandlerFunc(pprof.Profile)
+	case "symbol":
+		handler = http.HandlerFunc(pprof.Symbol)
+	case "trace":
+		handler = http.HandlerFunc(pprof.Trace)
+	default:
+		handler = pprof.Handler(name)
+	}
+
+	return adaptor.HTTPHandler(handler)(c)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPprof(t *testing.T) {
+	config := LoadConfig()
+	config.PprofEnabled = true
+	config.PprofToken = "secret"
+	config.RoutePrefix = "/prefix"
+	app := Setup(config)
+
+	for _, path := range []string{"/debug/pprof/cmdline", "/prefix/debug/pprof/cmdline", "/debug/pprof/heap"} {
+		resp, err := app.Test(httptest.NewRequest("GET", path, nil), -1)
+		assert.Nil(t, err)
+		assert.Equalf(t, 401, resp.StatusCode, "%s should require the token", path)
+
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err = app.Test(req, -1)
+		assert.Nil(t, err)
+		assert.Equalf(t, 200, resp.StatusCode, "%s should return 200 with the token", path)
+	}
+}
+
+func TestPprofDisabled(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("upstream"))
+	}))
+	defer upstream.Close()
+
+	config := LoadConfig()
+	config.GoogleOrigin = upstream.URL
+	config.PprofToken = "secret"
+	app := Setup(config)
+
+	req := httptest.NewRequest("GET", "/debug/pprof/cmdline", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := app.Test(req, -1)
+	assert.Nil(t, err)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, "upstream", string(body), "pprof should not be registered")
+}
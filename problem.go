@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// Base URI of the problem types
+const problemTypeBaseURI = "https://errors.gaxy.dev/"
+
+// Content type of the problem details responses
+const problemContentType = "application/problem+json"
+
+// Problem types by status code, the other status codes use "error"
+var problemTypes = map[int]string{
+	fiber.StatusBadRequest:            "bad-request",
+	fiber.StatusUnauthorized:          "unauthorized",
+	fiber.StatusForbidden:             "forbidden",
+	fiber.StatusNotFound:              "not-found",
+	fiber.StatusMethodNotAllowed:      "method-not-allowed",
+	fiber.StatusRequestEntityTooLarge: "request-too-large",
+	fiber.StatusRequestURITooLong:     "uri-too-long",
+	fiber.StatusInternalServerError:   "internal",
+	fiber.StatusBadGateway:            "upstream",
+	fiber.StatusServiceUnavailable:    "unavailable",
+	fiber.StatusGatewayTimeout:        "upstream-timeout",
+}
+
+// ProblemDetail is an error response as defined by RFC 7807
+type ProblemDetail struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+}
+
+// NewProblemDetail create the problem details of err, returned by a handler of c
+func NewProblemDetail(c *fiber.Ctx, err error) ProblemDetail {
+	status := fiber.StatusInternalServerError
+	detail := err.Error()
+	var e *fiber.Error
+	if errors.As(err, &e) {
+		status = e.Code
+		detail = e.Message
+	}
+
+	problemType, ok := problemTypes[status]
+	if !ok {
+		problemType = "error"
+	}
+
+	return ProblemDetail{
+		Type:     problemTypeBaseURI + problemType,
+		Title:    utils.StatusMessage(status),
+		Status:   status,
+		Detail:   detail,
+		Instance: c.Path(),
+	}
+}
+
+// Write err as problem details, or as plain text with LEGACY_ERROR_FORMAT=true
+func writeError(c *fiber.Ctx, err error, config Config) error {
+	if config.LegacyErrorFormat {
+		return fiber.DefaultErrorHandler(c, err)
+	}
+
+	problem := NewProblemDetail(c, err)
+	return c.Status(problem.Status).JSON(problem, problemContentType)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func TestNewProblemDetail(t *testing.T) {
+	app := fiber.New()
+	c := app.AcquireCtx(&fasthttp.RequestCtx{})
+	defer app.ReleaseCtx(c)
+	c.Path("/collect")
+
+	for status, problemType := range problemTypes {
+		problem := NewProblemDetail(c, fiber.NewError(status, "message"))
+		assert.Equal(t, ProblemDetail{
+			Type:     "https://errors.gaxy.dev/" + problemType,
+			Title:    fiber.NewError(status).Message,
+			Status:   status,
+			Detail:   "message",
+			Instance: "/collect",
+		}, problem)
+	}
+
+	problem := NewProblemDetail(c, fiber.NewError(fiber.StatusTeapot, "tea"))
+	assert.Equal(t, "https://errors.gaxy.dev/error", problem.Type)
+	assert.Equal(t, "I'm a teapot", problem.Title)
+
+	problem = NewProblemDetail(c, errors.New("dial failed"))
+	assert.Equal(t, "https://errors.gaxy.dev/internal", problem.Type)
+	assert.Equal(t, 500, problem.Status)
+	assert.Equal(t, "dial failed", problem.Detail)
+}
+
+func TestProblemDetailResponse(t *testing.T) {
+	config := LoadConfig()
+	config.AdminToken = "secret"
+	app := Setup(config)
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/admin/config", nil), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 401, resp.StatusCode)
+	assert.Equal(t, "application/problem+json", resp.Header.Get("Content-Type"))
+
+	var problem ProblemDetail
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&problem))
+	assert.Equal(t, ProblemDetail{
+		Type:     "https://errors.gaxy.dev/unauthorized",
+		Title:    "Unauthorized",
+		Status:   401,
+		Detail:   "Unauthorized",
+		Instance: "/admin/config",
+	}, problem)
+
+	resp, err = app.Test(httptest.NewRequest("GET", "/"+strings.Repeat("a", 3000), nil), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 414, resp.StatusCode)
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&problem))
+	assert.Equal(t, "https://errors.gaxy.dev/uri-too-long", problem.Type)
+	assert.Contains(t, problem.Detail, "exceeds the limit")
+}
+
+func TestLegacyErrorFormat(t *testing.T) {
+	config := LoadConfig()
+	config.AdminToken = "secret"
+	config.LegacyErrorFormat = true
+	app := Setup(config)
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/admin/config", nil), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 401, resp.StatusCode)
+	assert.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, "Unauthorized", string(body))
+}
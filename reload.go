@@ -0,0 +1,133 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+)
+
+// Config fields which are used at startup only, they can not be reloaded
+var staticConfigFields = map[string]bool{
+	"RoutePrefix":                 true,
+	"RoutePrefixRegex":            true,
+	"MaxURILength":                true,
+	"GoogleOrigin":                true,
+	"GoogleOrigins":               true,
+	"UpstreamWeights":             true,
+	"UpstreamCBThreshold":         true,
+	"UpstreamCBTimeout":           true,
+	"UpstreamMaxConcurrent":       true,
+	"UpstreamConcurrencyTimeout":  true,
+	"UpstreamHTTP2":               true,
+	"UpstreamMaxResponseSize":     true,
+	"UpstreamTLSCertFile":         true,
+	"UpstreamTLSKeyFile":          true,
+	"UpstreamTLSCAFile":           true,
+	"UpstreamDNSCacheTTL":         true,
+	"AllowUpstreamOverrideHeader": true,
+	"UpstreamAllowedHosts":        true,
+	"RequestMaxBodySize":          true,
+	"RouteTimeouts":               true,
+	"ProxyTimeout":                true,
+	"HealthTimeout":               true,
+	"IPAllowlist":                 true,
+	"TrustedProxies":              true,
+	"CORSAllowOrigins":            true,
+	"CORSAllowCredentials":        true,
+	"CORSPathOverrides":           true,
+	"IPBlocklist":                 true,
+	"PprofEnabled":                true,
+	"LogFormat":                   true,
+	"LogSampleRate":               true,
+	"AccessLogFile":               true,
+	"AccessLogFormat":             true,
+	"PprofPath":                   true,
+	"MirrorEndpoint":              true,
+	"MirrorMaxConcurrent":         true,
+	"ProxySecondaryTargets":       true,
+	"ProxySecondaryMaxConcurrent": true,
+	"MetricsPathLabelLimit":       true,
+	"ConfigFile":                  true,
+	"Port":                        true,
+}
+
+// ConfigStore holds the active config, which can be reloaded at runtime
+type ConfigStore struct {
+	mu     sync.RWMutex
+	config Config
+	load   func() (Config, error)
+}
+
+// NewConfigStore create a store with config as the active config
+func NewConfigStore(config Config) *ConfigStore {
+	return &ConfigStore{config: config, load: ReadConfig}
+}
+
+// Get returns the active config
+func (s *ConfigStore) Get() Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.config
+}
+
+// Reload load the config again and make it active.
+// Changes to static fields are ignored with a warning.
+func (s *ConfigStore) Reload() ([]FieldChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	config, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	var changes []FieldChange
+	v := reflect.ValueOf(&config).Elem()
+	for _, change := range Diff(&s.config, &config) {
+		if staticConfigFields[change.Field] {
+			log.Printf("Warning: %s can not be changed without restart, keep the current value", change.Field)
+			v.FieldByName(change.Field).Set(reflect.ValueOf(&s.config).Elem().FieldByName(change.Field))
+			continue
+		}
+
+		changes = append(changes, change)
+	}
+	for _, line := range s.config.Diff(&config) {
+		log.Printf("Config reloaded, %s", line)
+	}
+
+	s.config = config
+	return changes, nil
+}
+
+// Watch reload the config whenever one of the signals is received.
+// The returned function stops watching.
+func (s *ConfigStore) Watch(sig ...os.Signal) func() {
+	ch := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(ch, sig...)
+
+	go func() {
+		for {
+			select {
+			case <-ch:
+				if _, err := s.Reload(); err != nil {
+					log.Printf("Failed to reload config: %s", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(ch)
+		close(done)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigStoreReload(t *testing.T) {
+	config := LoadConfig()
+	store := NewConfigStore(config)
+
+	store.load = func() (Config, error) {
+		reloaded := config
+		reloaded.SkipParamsFromReqHeaders = "cid"
+		reloaded.Port = "9999"
+		return reloaded, nil
+	}
+
+	changes, err := store.Reload()
+	assert.Nil(t, err)
+	assert.Len(t, changes, 1, "only the dynamic field should change")
+	assert.Equal(t, "cid", store.Get().SkipParamsFromReqHeaders)
+	assert.Equal(t, config.Port, store.Get().Port, "static field should keep its value")
+}
+
+func TestConfigStoreReloadUpstreamFields(t *testing.T) {
+	config := LoadConfig()
+	store := NewConfigStore(config)
+
+	dir := t.TempDir()
+	writeTestCert(t, dir, "client", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "client"},
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}, nil, nil)
+
+	// Only applied when the upstream pool is created
+	store.load = func() (Config, error) {
+		reloaded := config
+		reloaded.UpstreamMaxResponseSize = "1MB"
+		reloaded.UpstreamTLSCertFile = filepath.Join(dir, "client.crt")
+		reloaded.UpstreamTLSKeyFile = filepath.Join(dir, "client.key")
+		reloaded.UpstreamTLSCAFile = filepath.Join(dir, "client.crt")
+		reloaded.UpstreamDNSCacheTTL = time.Hour
+		return reloaded, nil
+	}
+
+	changes, err := store.Reload()
+	assert.Nil(t, err)
+	assert.Empty(t, changes, "upstream fields should need a restart")
+	assert.Equal(t, config, store.Get())
+}
+
+func TestConfigStoreReloadUpstreamOverride(t *testing.T) {
+	config := LoadConfig()
+	store := NewConfigStore(config)
+
+	// The override header can only be enabled at startup, where a warning is logged
+	store.load = func() (Config, error) {
+		reloaded := config
+		reloaded.AllowUpstreamOverrideHeader = true
+		reloaded.UpstreamAllowedHosts = "*"
+		return reloaded, nil
+	}
+
+	changes, err := store.Reload()
+	assert.Nil(t, err)
+	assert.Empty(t, changes, "upstream override fields should need a restart")
+	assert.False(t, store.Get().AllowUpstreamOverrideHeader)
+	assert.Equal(t, "", store.Get().UpstreamAllowedHosts)
+}
+
+func TestConfigStoreReloadInvalid(t *testing.T) {
+	config := LoadConfig()
+	store := NewConfigStore(config)
+
+	store.load = func() (Config, error) {
+		reloaded := config
+		reloaded.UpstreamWeights = "1,2,3"
+		return reloaded, nil
+	}
+
+	_, err := store.Reload()
+	assert.NotNil(t, err)
+	assert.Equal(t, config, store.Get(), "invalid config should not be applied")
+}
+
+func TestConfigStoreWatchSIGHUP(t *testing.T) {
+	var upstreamQuery string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamQuery = r.URL.RawQuery
+	}))
+	defer upstream.Close()
+
+	config := LoadConfig()
+	config.GoogleOrigin = upstream.URL
+	store := NewConfigStore(config)
+	app := SetupWithStore(store, NewDrainer())
+
+	store.load = func() (Config, error) {
+		reloaded := config
+		reloaded.SkipParamsFromReqHeaders = "cid"
+		return reloaded, nil
+	}
+	stop := store.Watch(syscall.SIGHUP)
+	defer stop()
+
+	_, err := app.Test(httptest.NewRequest("GET", "/collect?cid=1&tid=UA-1", nil), -1)
+	assert.Nil(t, err)
+	assert.Contains(t, upstreamQuery, "cid=1")
+
+	assert.Nil(t, syscall.Kill(syscall.Getpid(), syscall.SIGHUP))
+	assert.Eventually(t, func() bool {
+		return store.Get().SkipParamsFromReqHeaders == "cid"
+	}, time.Second, 10*time.Millisecond)
+
+	_, err = app.Test(httptest.NewRequest("GET", "/collect?cid=1&tid=UA-1", nil), -1)
+	assert.Nil(t, err)
+	assert.NotContains(t, upstreamQuery, "cid=1", "reloaded config should take effect")
+	assert.Contains(t, upstreamQuery, "tid=UA-1")
+}
+
+func TestConfigReloadEndpoint(t *testing.T) {
+	config := LoadConfig()
+	config.AdminToken = "secret"
+	store := NewConfigStore(config)
+	app := SetupWithStore(store, NewDrainer())
+
+	store.load = func() (Config, error) {
+		reloaded := config
+		reloaded.ForwardCookieNames = "_ga"
+		return reloaded, nil
+	}
+
+	req := httptest.NewRequest("GET", "/config/reload", nil)
+	resp, err := app.Test(req, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 401, resp.StatusCode, "should require the admin token")
+	assert.Equal(t, "", store.Get().ForwardCookieNames)
+
+	req = httptest.NewRequest("GET", "/config/reload", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err = app.Test(req, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "_ga", store.Get().ForwardCookieNames)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/url"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// SecondaryTargets forwards a copy of every proxied request to the
+// PROXY_SECONDARY_TARGETS, e.g. a self-hosted Matomo or Plausible. The copies
+// do not block the primary response, their failures are logged and counted.
+type SecondaryTargets struct {
+	mirror  *Mirror
+	targets []string
+}
+
+// NewSecondaryTargets create the fan-out to PROXY_SECONDARY_TARGETS, at most
+// PROXY_SECONDARY_MAX_CONCURRENT copies are in flight, the other ones are dropped
+func NewSecondaryTargets(config Config, metrics *Metrics) *SecondaryTargets {
+	targets, _ := config.GetSecondaryTargets()
+	mirror := newMirror("", config.ProxySecondaryMaxConcurrent)
+	mirror.OnError = func(endpoint string) {
+		if u, err := url.Parse(endpoint); err == nil {
+			metrics.RecordSecondaryError(u.Host)
+		}
+	}
+
+	return &SecondaryTargets{mirror: mirror, targets: targets}
+}
+
+// Handler send the request to every secondary target
+func (s *SecondaryTargets) Handler(c *fiber.Ctx) error {
+	config := c.Locals("config").(Config)
+
+	for _, target := range s.targets {
+		s.mirror.Send(c, target, config.ProxySecondaryTimeout)
+	}
+
+	return c.Next()
+}
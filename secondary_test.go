@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecondaryTargets(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("primary"))
+	}))
+	defer upstream.Close()
+
+	received := make(chan string, 2)
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.URL.RequestURI()
+		w.Write([]byte("secondary"))
+	}))
+	defer secondary.Close()
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+
+	send := func(config Config) {
+		resp, err := Setup(config).Test(httptest.NewRequest("GET", "/collect?tid=UA-1", nil), -1)
+		assert.Nil(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		assert.Equal(t, "primary", string(body), "primary response should be returned")
+	}
+
+	config := LoadConfig()
+	config.GoogleOrigin = upstream.URL
+
+	// Primary only
+	send(config)
+
+	// Primary and secondary
+	config.ProxySecondaryTargets = secondary.URL + "/matomo"
+	assert.Nil(t, config.Validate())
+	send(config)
+	select {
+	case uri := <-received:
+		assert.Equal(t, "/matomo/collect?tid=UA-1", uri)
+	case <-time.After(time.Second):
+		t.Fatal("request should be sent to the secondary target")
+	}
+
+	// Secondary failure does not fail the request, and is counted
+	config.ProxySecondaryTargets = down.URL + "," + secondary.URL
+	assert.Nil(t, config.Validate())
+	app := Setup(config)
+	resp, err := app.Test(httptest.NewRequest("GET", "/collect", nil), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	<-received
+
+	downHost := strings.TrimPrefix(down.URL, "http://")
+	assert.Eventually(t, func() bool {
+		resp, err := app.Test(httptest.NewRequest("GET", "/metrics", nil), -1)
+		assert.Nil(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		return strings.Contains(string(body), `gaxy_secondary_errors_total{backend="`+downHost+`"} 1`)
+	}, time.Second, 10*time.Millisecond)
+
+	config.ProxySecondaryTargets = "matomo.example.com"
+	assert.NotNil(t, config.Validate())
+}
@@ -1,54 +1,241 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/url"
+	"os"
+	"os/signal"
 	"reflect"
 	"strings"
+	"syscall"
 	"unsafe"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
 	"github.com/valyala/fasthttp"
 )
 
-var proxyClient = &fasthttp.Client{}
+// Google domains replaced by gaxy in the response body
+var googleDomains = []string{
+	"ssl.google-analytics.com",
+	"www.google-analytics.com",
+	"google-analytics.com",
+	"www.googletagmanager.com",
+	"googletagmanager.com",
+}
+
+// Upstream response headers forwarded with CACHE_PASSTHROUGH_HEADERS=true
+var cacheHeaders = []string{
+	fasthttp.HeaderCacheControl,
+	fasthttp.HeaderETag,
+	fasthttp.HeaderLastModified,
+	fasthttp.HeaderExpires,
+}
 
 func main() {
-	var config = LoadConfig()
-	var app = Setup(config)
+	config, err := ReadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := config.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("gaxy %s (%s, built %s)", Version, GitCommit, BuildTime)
+	log.Printf("Config: %v", config.ToRedactedMap())
+
+	var store = NewConfigStore(config)
+	store.Watch(syscall.SIGHUP)
+	var drainer = NewDrainer()
+	var app = SetupWithStore(store, drainer)
+
+	// Drain on SIGTERM, shut down once the in-flight requests are done
+	sigterm := make(chan os.Signal, 1)
+	signal.Notify(sigterm, syscall.SIGTERM)
+	go func() {
+		<-sigterm
+		log.Printf("Received SIGTERM, draining")
+		drainer.Drain()
+	}()
+	go func() {
+		<-drainer.Done()
+		log.Printf("Drained, shutting down")
+		if err := app.Shutdown(); err != nil {
+			log.Printf("Failed to shut down: %s", err)
+		}
+	}()
 
 	// Start server
 	log.Printf("Listen on port %s", config.Port)
-	log.Fatal(app.Listen(fmt.Sprintf(":%s", config.Port)))
+	if err := app.Listen(fmt.Sprintf(":%s", config.Port)); err != nil {
+		log.Fatal(err)
+	}
 }
 
 // Setup Setup a fiber app with all of its routes
 func Setup(config Config) *fiber.App {
-	app := fiber.New()
+	return SetupWithStore(NewConfigStore(config), NewDrainer())
+}
+
+// SetupWithStore Setup a fiber app which reads its config from a reloadable store.
+// The drainer tracks the proxied requests, see POST /admin/drain.
+// The readiness checkers are used by /healthz/ready in addition to the upstream check.
+func SetupWithStore(store *ConfigStore, drainer *Drainer, readiness ...ReadinessChecker) *fiber.App {
+	config := store.Get()
+
+	metrics := NewMetrics(config.MetricsPathLabelLimit)
+	bodyLimit, err := config.GetRequestMaxBodySize()
+	if err != nil {
+		log.Fatal(err)
+	}
+	app := fiber.New(fiber.Config{
+		// Larger bodies are rejected with 413 by the server before being read
+		BodyLimit: bodyLimit,
+		// The request line and headers must fit, or the server rejects them with 431
+		ReadBufferSize: config.GetReadBufferSize(),
+		ErrorHandler: func(c *fiber.Ctx, err error) error {
+			if errors.Is(err, fiber.ErrRequestEntityTooLarge) {
+				metrics.RecordBodyTooLarge()
+			}
+			return writeError(c, err, store.Get())
+		},
+	})
+
+	upstreams, err := NewUpstreamPool(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	upstreams.RecordCircuitEvents(metrics)
+	upstreams.RecordDNSCacheEvents(metrics)
+	upstreams.RecordConcurrencyEvents(metrics)
+	ipList, err := config.GetIPList()
+	if err != nil {
+		log.Fatal(err)
+	}
+	trustedProxies, err := config.GetTrustedProxies()
+	if err != nil {
+		log.Fatal(err)
+	}
+	routeTimeouts, err := config.GetRouteTimeouts()
+	if err != nil {
+		log.Fatal(err)
+	}
+	routePrefixRegexp, err := config.GetRoutePrefixRegexp()
+	if err != nil {
+		log.Fatal(err)
+	}
+	corsOverrides, err := config.GetCORSPathOverrides()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if config.AllowUpstreamOverrideHeader {
+		log.Printf("Warning: ALLOW_UPSTREAM_OVERRIDE_HEADER is enabled, requests can choose their upstream among %s with the %s header",
+			config.UpstreamAllowedHosts, upstreamOverrideHeader)
+	}
+	readiness = append([]ReadinessChecker{drainer, upstreamReadiness{store: store, pool: upstreams}}, readiness...)
 
 	// Config object
 	app.Use(func(c *fiber.Ctx) error {
-		c.Locals("config", config)
+		c.Locals("config", store.Get())
+		c.Locals("configStore", store)
+		c.Locals("upstreams", upstreams)
+		c.Locals("metrics", metrics)
+		c.Locals("readiness", readiness)
+		c.Locals("drainer", drainer)
 		return c.Next()
 	})
 
+	// Client IP
+	app.Use(realIP(trustedProxies))
+
+	// Request metrics
+	app.Use(requestMetrics(metrics))
+
+	// IP allowlist, blocklist
+	if !ipList.Empty() {
+		app.Use(ipFilter(ipList))
+	}
+
 	// CORS
-	app.Use(cors.New())
+	app.Use(corsByPath(config, corsOverrides, routePrefixRegexp))
+
+	// Security headers
+	app.Use(securityHeaders)
+
+	// Compression
+	app.Use(compress)
 
 	// Logger
-	app.Use(logger.New())
+	accessLog := io.Writer(os.Stdout)
+	if config.AccessLogFile != "" {
+		file, err := OpenLogFile(config.AccessLogFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		stop := file.Watch(syscall.SIGUSR1)
+		app.Hooks().OnShutdown(func() error {
+			stop()
+			return file.Close()
+		})
+		accessLog = file
+	}
+	app.Use(newLogger(config, accessLog, metrics))
 
 	// Handler
-	if config.RoutePrefix != "" {
+	proxyHandlers := []fiber.Handler{handleRequestAndRedirect}
+	if config.ProxySecondaryTargets != "" {
+		proxyHandlers = append([]fiber.Handler{NewSecondaryTargets(config, metrics).Handler}, proxyHandlers...)
+	}
+	if config.MirrorEndpoint != "" {
+		proxyHandlers = append([]fiber.Handler{NewMirror(config, metrics).Handler}, proxyHandlers...)
+	}
+	if len(routeTimeouts) > 0 {
+		proxyHandlers = append([]fiber.Handler{routeTimeout(routeTimeouts)}, proxyHandlers...)
+	}
+	proxyHandlers = append([]fiber.Handler{drainer.Handler, handlerTimeout(config.ProxyTimeout, "upstream request timed out")}, proxyHandlers...)
+	healthTimeout := handlerTimeout(config.HealthTimeout, "health check timed out")
+
+	if routePrefixRegexp != nil {
+		app.Use(routePrefixRegex(routePrefixRegexp))
+	} else if config.RoutePrefix != "" {
 		subRoute := app.Group(config.RoutePrefix)
-		subRoute.Get("/ping", pingHandler)
-		subRoute.All("/*", handleRequestAndRedirect)
+		subRoute.Get("/ping", healthTimeout, pingHandler)
+		subRoute.Get("/health", healthTimeout, healthHandler)
+		subRoute.Get("/version", versionHandler)
+		subRoute.Get("/metrics", metricsHandler)
+		subRoute.Get("/healthz/live", healthTimeout, liveHandler)
+		subRoute.Get("/healthz/ready", healthTimeout, readyHandler)
+		subRoute.Get("/config/reload", adminAuth, reloadConfigHandler)
+		subRoute.Get("/admin/config", adminAuth, adminConfigHandler)
+		subRoute.Post("/admin/metrics/reset", adminAuth, resetMetricsHandler)
+		subRoute.Post("/admin/drain", adminAuth, drainHandler)
+		subRoute.Get("/admin/drain/status", adminAuth, drainStatusHandler)
+		if config.PprofEnabled {
+			registerPprof(subRoute, config.PprofPath)
+		}
+		subRoute.All("/*", proxyHandlers...)
+	}
+	app.Get("/ping", healthTimeout, pingHandler)
+	app.Get("/health", healthTimeout, healthHandler)
+	app.Get("/version", versionHandler)
+	app.Get("/metrics", metricsHandler)
+	app.Get("/healthz/live", healthTimeout, liveHandler)
+	app.Get("/healthz/ready", healthTimeout, readyHandler)
+	app.Get("/config/reload", adminAuth, reloadConfigHandler)
+	app.Get("/admin/config", adminAuth, adminConfigHandler)
+	app.Post("/admin/metrics/reset", adminAuth, resetMetricsHandler)
+	app.Post("/admin/drain", adminAuth, drainHandler)
+	app.Get("/admin/drain/status", adminAuth, drainStatusHandler)
+	if config.PprofEnabled {
+		registerPprof(app, config.PprofPath)
 	}
-	app.Get("/ping", pingHandler)
-	app.All("/*", handleRequestAndRedirect)
+	app.All("/*", proxyHandlers...)
 
 	return app
 }
@@ -58,10 +245,55 @@ func pingHandler(c *fiber.Ctx) error {
 	return c.Send([]byte("pong"))
 }
 
+// Admin endpoints are protected by ADMIN_TOKEN bearer auth,
+// and disabled when ADMIN_TOKEN is not set
+func adminAuth(c *fiber.Ctx) error {
+	config := c.Locals("config").(Config)
+	if config.AdminToken == "" {
+		return fiber.ErrNotFound
+	}
+
+	expected := []byte("Bearer " + config.AdminToken)
+	if subtle.ConstantTimeCompare([]byte(c.Get(fiber.HeaderAuthorization)), expected) != 1 {
+		return fiber.ErrUnauthorized
+	}
+
+	return c.Next()
+}
+
+// Reload config handler
+func reloadConfigHandler(c *fiber.Ctx) error {
+	store := c.Locals("configStore").(*ConfigStore)
+
+	changes, err := store.Reload()
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	changed := []string{}
+	for _, change := range changes {
+		changed = append(changed, change.Field)
+	}
+
+	return c.JSON(fiber.Map{"reloaded": true, "changed": changed})
+}
+
+// Active config handler, the sensitive values are redacted
+func adminConfigHandler(c *fiber.Ctx) error {
+	config := c.Locals("config").(Config)
+
+	return c.JSON(config.ToRedactedMap())
+}
+
 // Given a request send it to the appropriate url
 func handleRequestAndRedirect(c *fiber.Ctx) error {
 	config := c.Locals("config").(Config)
 
+	// Reject suspiciously long URIs before doing any work on them
+	if err := validateRequestURI(c.Request().RequestURI(), config); err != nil {
+		return err
+	}
+
 	upstreamReq := fasthttp.AcquireRequest()
 	upstreamResp := fasthttp.AcquireResponse()
 
@@ -71,55 +303,187 @@ func handleRequestAndRedirect(c *fiber.Ctx) error {
 	c.Request().CopyTo(upstreamReq)
 
 	// Trim prefix
-	reqURI := string(c.Request().RequestURI())
-	if config.RoutePrefix != "" && strings.HasPrefix(reqURI, config.RoutePrefix+"/") {
-		reqURI = strings.TrimPrefix(reqURI, config.RoutePrefix)
-		upstreamReq.SetRequestURI(reqURI)
+	upstreamReq.SetRequestURI(trimRoutePrefix(string(c.Request().RequestURI()), config))
+
+	if err := validateGA4Request(string(upstreamReq.URI().Path()), upstreamReq.URI().QueryArgs(), config); err != nil {
+		return err
+	}
+
+	// Select the upstream, fail fast while all of them are down
+	upstream, err := upstreamOverride(c, config)
+	if err != nil {
+		return err
+	}
+	upstreamReq.Header.Del(upstreamOverrideHeader)
+	pool := c.Locals("upstreams").(*UpstreamPool)
+	if upstream == nil {
+		upstream = pool.Next()
+	}
+	if upstream == nil || !upstream.Breaker.Allow() {
+		return fiber.NewError(fiber.StatusServiceUnavailable, "upstream circuit breaker is open")
 	}
+
 	// Overwrite
-	url, _ := url.Parse(config.GoogleOrigin)
-	upstreamReq.SetHost(url.Host)
-	upstreamReq.URI().SetScheme(url.Scheme)
+	upstreamReq.SetHost(upstream.URL.Host)
+	upstreamReq.URI().SetScheme(upstream.URL.Scheme)
 
 	// Prepare request
-	prepareRequest(upstreamReq, c)
+	if err := prepareRequest(upstreamReq, c); err != nil {
+		upstream.Breaker.Cancel()
+		return err
+	}
 	log.Printf("GET %s -> making request to %s", c.Params("*"), upstreamReq.URI().FullURI())
 
-	// Start request to dest URL
-	if err := proxyClient.Do(upstreamReq, upstreamResp); err != nil {
+	// Start request to dest URL, limited by UPSTREAM_MAX_CONCURRENT and the request context deadline
+	if err := pool.DoWithContext(c.UserContext(), upstreamReq, upstreamResp); err != nil {
+		if err == ErrUpstreamBusy {
+			upstream.Breaker.Cancel()
+			return fiber.NewError(fiber.StatusServiceUnavailable, err.Error())
+		}
+		upstream.Breaker.Failure()
+		if isUpstreamTimeout(err) {
+			return fiber.NewError(fiber.StatusGatewayTimeout, "upstream request timed out")
+		}
+		if err == fasthttp.ErrBodyTooLarge {
+			return responseTooLarge(c, upstream)
+		}
 		return err
 	}
+	if upstreamResp.StatusCode() >= fiber.StatusInternalServerError {
+		upstream.Breaker.Failure()
+	} else {
+		upstream.Breaker.Success()
+	}
+
+	if config.ProxyDebugRequests && sampleRequest(c.Context().ID(), config.DebugSamplingRate) {
+		logUpstreamExchange(c.Context().ID(), upstreamReq, upstreamResp)
+	}
 
 	// Post process the response
 	if err := postprocessResponse(upstreamResp, c); err != nil {
+		if err == fasthttp.ErrBodyTooLarge {
+			return responseTooLarge(c, upstream)
+		}
 		return err
 	}
 
 	return nil
 }
 
+// Header overriding the upstream origin, with ALLOW_UPSTREAM_OVERRIDE_HEADER=true
+const upstreamOverrideHeader = "X-GA-Upstream"
+
+// Upstream of the X-GA-Upstream header, nil when the header is not used.
+// The origin must be https and its host must match UPSTREAM_ALLOWED_HOSTS.
+func upstreamOverride(c *fiber.Ctx, config Config) (*Upstream, error) {
+	value := c.Get(upstreamOverrideHeader)
+	if !config.AllowUpstreamOverrideHeader || value == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(value)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, fiber.NewError(fiber.StatusBadRequest,
+			fmt.Sprintf("invalid %s %q, expected an https origin", upstreamOverrideHeader, value))
+	}
+	if !config.IsUpstreamHostAllowed(u.Hostname()) {
+		return nil, fiber.NewError(fiber.StatusBadRequest,
+			fmt.Sprintf("%s host %q is not in UPSTREAM_ALLOWED_HOSTS", upstreamOverrideHeader, u.Hostname()))
+	}
+
+	// Not part of the pool, so without circuit breaker
+	return &Upstream{URL: u, Weight: 1, Breaker: NewCircuitBreaker(0, 0)}, nil
+}
+
+// Whether err is a timeout of the upstream request, or of the connection to the upstream
+func isUpstreamTimeout(err error) bool {
+	var netErr net.Error
+	return err == fasthttp.ErrTimeout || errors.Is(err, fasthttp.ErrDialTimeout) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// Reject a response exceeding UPSTREAM_MAX_RESPONSE_SIZE
+func responseTooLarge(c *fiber.Ctx, upstream *Upstream) error {
+	c.Locals("metrics").(*Metrics).RecordResponseTooLarge(upstream.URL.Host)
+	return fiber.NewError(fiber.StatusBadGateway, "upstream response too large")
+}
+
+// Trim ROUTE_PREFIX from the request URI. With ROUTE_PREFIX_REGEX=true,
+// the prefix is already trimmed by the routePrefixRegex middleware.
+func trimRoutePrefix(reqURI string, config Config) string {
+	if config.RoutePrefix != "" && !config.RoutePrefixRegex && strings.HasPrefix(reqURI, config.RoutePrefix+"/") {
+		return strings.TrimPrefix(reqURI, config.RoutePrefix)
+	}
+
+	return reqURI
+}
+
+// Validate the length of the request URI and its path component
+func validateRequestURI(requestURI []byte, config Config) error {
+	if config.MaxURILength > 0 && len(requestURI) > config.MaxURILength {
+		return fiber.NewError(fiber.StatusRequestURITooLong,
+			fmt.Sprintf("request URI is %d bytes, exceeds the limit of %d bytes", len(requestURI), config.MaxURILength))
+	}
+
+	path := requestURI
+	if i := bytes.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	if config.MaxPathLength > 0 && len(path) > config.MaxPathLength {
+		return fiber.NewError(fiber.StatusRequestURITooLong,
+			fmt.Sprintf("request path is %d bytes, exceeds the limit of %d bytes", len(path), config.MaxPathLength))
+	}
+
+	return nil
+}
+
+// GA4 Measurement Protocol paths requiring the api_secret parameter,
+// see https://developers.google.com/analytics/devguides/collection/protocol/ga4/reference
+var ga4MeasurementProtocolPaths = []string{
+	// Measurement Protocol (GA4) hits
+	"/mp/collect",
+	// Validation server, https://developers.google.com/analytics/devguides/collection/protocol/ga4/validating-events
+	"/debug/mp/collect",
+}
+
+// Validate the GA4 Measurement Protocol parameters, with STRICT_GA4_VALIDATION=true.
+// GA4 accepts requests without api_secret with 2xx but drops the events.
+func validateGA4Request(path string, args *fasthttp.Args, config Config) error {
+	if !config.StrictGA4Validation {
+		return nil
+	}
+
+	for _, mpPath := range ga4MeasurementProtocolPaths {
+		if path == mpPath && len(args.Peek("api_secret")) == 0 {
+			return fiber.NewError(fiber.StatusBadRequest,
+				fmt.Sprintf("missing api_secret parameter, required by the GA4 Measurement Protocol on %s", path))
+		}
+	}
+
+	return nil
+}
+
 // Prepare request
-func prepareRequest(upstreamResp *fasthttp.Request, c *fiber.Ctx) {
+func prepareRequest(upstreamResp *fasthttp.Request, c *fiber.Ctx) error {
 	config := c.Locals("config").(Config)
 
-	for _, name := range strings.Split(config.InjectParamsFromReqHeaders, ",") {
+	mappings, err := config.GetInjectHeaders()
+	if err != nil {
+		return err
+	}
+	for _, m := range mappings {
 		// Convert header fields to request params
 		// e.g. INJECT_PARAMS_FROM_REQ_HEADERS=uip,user-agent
 		//   will be add this to the URI: ?uip=[VALUE]&user-agent=[VALUE]
 		// To rename the key, use [HEADER_NAME]__[NEW_NAME]
 		// e.g. INJECT_PARAMS_FROM_REQ_HEADERS=x-email__uip,user-agent__ua
-		if name != "" {
-			if strings.Contains(name, "__") {
-				ss := strings.Split(name, "__")
-				val := c.Get(ss[0])
-				upstreamResp.URI().QueryArgs().Add(ss[1], val)
-				log.Printf("Added %s=%s to query string\n", ss[1], val)
-			} else {
-				val := c.Get(name)
-				upstreamResp.URI().QueryArgs().Add(name, val)
-				log.Printf("Added %s=%s to query string\n", name, val)
-			}
+		// To take a comma-separated token, use [HEADER_NAME]__[NEW_NAME]__[INDEX]
+		// e.g. INJECT_PARAMS_FROM_REQ_HEADERS=x-forwarded-for__uip__0
+		val, ok := m.Value(c.Get(m.Header))
+		if !ok {
+			continue
 		}
+		upstreamResp.URI().QueryArgs().Add(m.Param, val)
+		log.Printf("Added %s=%s to query string\n", m.Param, val)
 	}
 
 	for _, name := range strings.Split(config.SkipParamsFromReqHeaders, ",") {
@@ -130,9 +494,21 @@ func prepareRequest(upstreamResp *fasthttp.Request, c *fiber.Ctx) {
 		}
 	}
 
+	// Forward only the allowed cookies, strip the others
+	upstreamResp.Header.DelAllCookies()
+	for _, name := range strings.Split(config.ForwardCookieNames, ",") {
+		if name != "" {
+			if val := c.Cookies(name); val != "" {
+				upstreamResp.Header.SetCookie(name, val)
+			}
+		}
+	}
+
 	// Overwrite IP, UA
-	upstreamResp.URI().QueryArgs().Add("uip", c.IP())
+	upstreamResp.URI().QueryArgs().Add("uip", getRealIP(c))
 	upstreamResp.URI().QueryArgs().Add("ua", c.Get("User-Agent"))
+
+	return nil
 }
 
 // Post process response
@@ -142,36 +518,88 @@ func postprocessResponse(upstreamResp *fasthttp.Response, c *fiber.Ctx) error {
 	// Add header
 	upstreamResp.Header.Add("x-proxy-by", "gaxy")
 
-	bodyString, err := GetBodyString(upstreamResp)
-	if err != nil {
-		return err
-	}
-
 	var contentType = string(upstreamResp.Header.ContentType())
-	if strings.HasPrefix(contentType, "text/javascript") || strings.HasPrefix(contentType, "application/javascript") {
-		find := []string{
-			"ssl.google-analytics.com",
-			"www.google-analytics.com",
-			"google-analytics.com",
-			"www.googletagmanager.com",
-			"googletagmanager.com",
+	if shouldDecompress(contentType, config) {
+		maxBytes := c.Locals("upstreams").(*UpstreamPool).Client.MaxResponseBodySize
+		bodyString, err := GetBodyString(upstreamResp, maxBytes)
+		if err != nil {
+			return err
+		}
+
+		if shouldReplaceBody(contentType, config) {
+			currentHost := getGaxyHostName(c)
+			routePrefix := config.RoutePrefix
+			if config.RoutePrefixRegex {
+				routePrefix, _ = c.Locals("route_prefix").(string)
+			}
+
+			for _, toReplace := range googleDomains {
+				bodyString = strings.ReplaceAll(bodyString, toReplace, currentHost+routePrefix)
+			}
+		}
+
+		if config.InjectIntegrityHash {
+			c.Response().Header.Set("X-Content-Integrity", ComputeIntegrityHash([]byte(bodyString)))
 		}
-		currentHost := getGaxyHostName(c)
 
-		for _, toReplace := range find {
-			bodyString = strings.ReplaceAll(bodyString, toReplace, currentHost+config.RoutePrefix)
+		c.Response().SetBodyString(bodyString)
+	} else {
+		// Pass the body through as is, keeping its encoding
+		if encoding := upstreamResp.Header.Peek(fasthttp.HeaderContentEncoding); len(encoding) > 0 {
+			c.Response().Header.SetBytesV(fasthttp.HeaderContentEncoding, encoding)
+		}
+		c.Response().SetBody(upstreamResp.Body())
+	}
+
+	if config.CachePassthroughHeaders {
+		for _, name := range cacheHeaders {
+			if val := upstreamResp.Header.Peek(name); len(val) > 0 {
+				c.Response().Header.SetBytesV(name, val)
+			}
 		}
 	}
 
-	c.Response().SetBodyString(bodyString)
 	c.Response().Header.SetContentType(string(upstreamResp.Header.ContentType()))
 	c.Response().SetStatusCode(upstreamResp.StatusCode())
 
+	// Forward the upstream cookies, they are stripped with the default STRIP_RESPONSE_HEADERS
+	upstreamResp.Header.VisitAllCookie(func(key, value []byte) {
+		c.Response().Header.Add(fasthttp.HeaderSetCookie, string(value))
+	})
+
+	// Strip unsafe headers, then add the custom ones
+	for _, name := range config.StripResponseHeaders {
+		c.Response().Header.Del(strings.TrimSpace(name))
+	}
+	for _, header := range config.AddResponseHeaders {
+		if name, value, ok := strings.Cut(header, ":"); ok {
+			c.Response().Header.Set(strings.TrimSpace(name), strings.TrimSpace(value))
+		}
+	}
+
 	return nil
 }
 
-// GetBodyString get body string from fasthttp.Response
-func GetBodyString(r *fasthttp.Response) (string, error) {
+// Whether the body has to be decompressed, only when it is modified or hashed
+func shouldDecompress(contentType string, config Config) bool {
+	return shouldReplaceBody(contentType, config) || config.InjectIntegrityHash
+}
+
+// Whether the Google domains in the body should be replaced,
+// based on BODY_REPLACE_CONTENT_TYPES
+func shouldReplaceBody(contentType string, config Config) bool {
+	for _, prefix := range strings.Split(config.BodyReplaceContentTypes, ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" && strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetBodyString get body string from fasthttp.Response,
+// fails with fasthttp.ErrBodyTooLarge if the decompressed body exceeds maxBytes (0 for no limit)
+func GetBodyString(r *fasthttp.Response, maxBytes int) (string, error) {
 	var body []byte
 	var err error
 
@@ -189,11 +617,20 @@ func GetBodyString(r *fasthttp.Response) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	if maxBytes > 0 && len(body) > maxBytes {
+		return "", fasthttp.ErrBodyTooLarge
+	}
 
 	bodyString := string(body)
 	return bodyString, nil
 }
 
+// ComputeIntegrityHash compute the subresource integrity hash (sha384) of body
+func ComputeIntegrityHash(body []byte) string {
+	sum := sha512.Sum384(body)
+	return "sha384-" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
 func getGaxyHostName(c *fiber.Ctx) string {
 	if host := c.Get("X-Forwarded-Host", ""); host != "" {
 		return host
@@ -1,12 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha512"
+	"encoding/base64"
+	"io"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"strings"
 	"testing"
 
+	"github.com/gofiber/fiber/v2"
 	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
 )
 
 func TestServer(t *testing.T) {
@@ -116,6 +127,25 @@ func TestInjectHeader(t *testing.T) {
 	assert.NotEmpty(t, string(body))
 }
 
+func TestInjectHeaderInvalid(t *testing.T) {
+	called := false
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer upstream.Close()
+
+	// Rejected by Validate, used as is by Setup
+	config := LoadConfig()
+	config.GoogleOrigin = upstream.URL
+	config.InjectParamsFromReqHeaders = "x-forwarded-for__uip__first"
+	assert.NotNil(t, config.Validate())
+
+	resp, err := Setup(config).Test(httptest.NewRequest("GET", "/collect", nil), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 500, resp.StatusCode)
+	assert.False(t, called, "should not be sent without the injected parameters")
+}
+
 func TestContentReplacementWithPrefix(t *testing.T) {
 	config := LoadConfig()
 	config.RoutePrefix = "/prefix"
@@ -148,3 +178,557 @@ func TestBehindReverseProxy(t *testing.T) {
 
 	assert.Contains(t, string(body), "hihihi.com/prefix")
 }
+
+func TestForwardCookieNames(t *testing.T) {
+	var upstreamCookie string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCookie = r.Header.Get("Cookie")
+	}))
+	defer upstream.Close()
+
+	config := LoadConfig()
+	config.GoogleOrigin = upstream.URL
+	config.ForwardCookieNames = "_ga,_gid"
+	app := Setup(config)
+
+	req := httptest.NewRequest("GET", "/collect", nil)
+	req.Header.Add("Cookie", "_ga=GA1.1.123; session=secret; _gid=GA1.1.456")
+
+	resp, err := app.Test(req, -1)
+	assert.Nilf(t, err, "err should be nil")
+	assert.Equalf(t, 200, resp.StatusCode, "statusCode should be 200")
+
+	assert.Contains(t, upstreamCookie, "_ga=GA1.1.123")
+	assert.Contains(t, upstreamCookie, "_gid=GA1.1.456")
+	assert.NotContains(t, upstreamCookie, "session", "not allowed cookie should be stripped")
+}
+
+func TestStripCookies(t *testing.T) {
+	var upstreamCookie string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCookie = r.Header.Get("Cookie")
+		w.Header().Set("Set-Cookie", "NID=1; Domain=google.com")
+	}))
+	defer upstream.Close()
+
+	config := LoadConfig()
+	config.GoogleOrigin = upstream.URL
+	app := Setup(config)
+
+	req := httptest.NewRequest("GET", "/collect", nil)
+	req.Header.Add("Cookie", "_ga=GA1.1.123; session=secret")
+
+	resp, err := app.Test(req, -1)
+	assert.Nilf(t, err, "err should be nil")
+	assert.Empty(t, upstreamCookie, "all cookies should be stripped")
+	assert.Empty(t, resp.Header.Get("Set-Cookie"), "upstream cookie should be stripped by default")
+
+	config.StripResponseHeaders = []string{"Server"}
+	resp, err = Setup(config).Test(httptest.NewRequest("GET", "/collect", nil), -1)
+	assert.Nilf(t, err, "err should be nil")
+	assert.Equal(t, "NID=1; Domain=google.com", resp.Header.Get("Set-Cookie"), "upstream cookie should be kept when not stripped")
+}
+
+func TestComputeIntegrityHash(t *testing.T) {
+	body := []byte("console.log('gaxy')")
+	sum := sha512.Sum384(body)
+
+	hash := ComputeIntegrityHash(body)
+	assert.Equal(t, "sha384-"+base64.StdEncoding.EncodeToString(sum[:]), hash)
+
+	body[0] = 'C'
+	assert.NotEqual(t, hash, ComputeIntegrityHash(body), "hash should change when body changes")
+}
+
+func TestInjectIntegrityHash(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/javascript")
+		w.Write([]byte("var u='https://www.google-analytics.com/collect'"))
+	}))
+	defer upstream.Close()
+
+	config := LoadConfig()
+	config.GoogleOrigin = upstream.URL
+	config.InjectIntegrityHash = true
+	app := Setup(config)
+
+	req := httptest.NewRequest("GET", "/analytics.js", nil)
+	resp, err := app.Test(req, -1)
+	assert.Nilf(t, err, "err should be nil")
+
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nilf(t, err, "err should be nil")
+	assert.Equal(t, ComputeIntegrityHash(body), resp.Header.Get("X-Content-Integrity"))
+}
+
+func TestMaxURILength(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	config := LoadConfig()
+	config.GoogleOrigin = upstream.URL
+	config.MaxURILength = 64
+	config.MaxPathLength = 32
+	app := Setup(config)
+
+	tests := []struct {
+		name       string
+		uri        string
+		statusCode int
+	}{
+		{"path at limit", "/" + strings.Repeat("a", 31), 200},
+		{"path over limit", "/" + strings.Repeat("a", 32), 414},
+		{"uri at limit", "/collect?v=" + strings.Repeat("a", 53), 200},
+		{"uri over limit", "/collect?v=" + strings.Repeat("a", 54), 414},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.uri, nil)
+			resp, err := app.Test(req, -1)
+			assert.Nilf(t, err, "err should be nil")
+			assert.Equalf(t, tt.statusCode, resp.StatusCode, "statusCode should be %d", tt.statusCode)
+		})
+	}
+
+	// The default limit is larger than the fiber default read buffer
+	config = LoadConfig()
+	config.GoogleOrigin = upstream.URL
+	assert.Equal(t, 8192, config.MaxURILength)
+	app = Setup(config)
+
+	uri := "/collect?v=" + strings.Repeat("a", 8192-len("/collect?v="))
+	resp, err := app.Test(httptest.NewRequest("GET", uri, nil), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode, "uri at the default limit")
+
+	resp, err = app.Test(httptest.NewRequest("GET", uri+"a", nil), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 414, resp.StatusCode, "uri over the default limit")
+}
+
+func TestUpstreamCircuitBreaker(t *testing.T) {
+	var hits int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer upstream.Close()
+
+	config := LoadConfig()
+	config.GoogleOrigin = upstream.URL
+	config.UpstreamCBThreshold = 2
+	app := Setup(config)
+
+	for i := 0; i < 2; i++ {
+		resp, err := app.Test(httptest.NewRequest("GET", "/collect", nil), -1)
+		assert.Nilf(t, err, "err should be nil")
+		assert.Equalf(t, 500, resp.StatusCode, "statusCode should be 500")
+	}
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/collect", nil), -1)
+	assert.Nilf(t, err, "err should be nil")
+	assert.Equalf(t, 503, resp.StatusCode, "statusCode should be 503 when the breaker is open")
+	assert.Equal(t, 2, hits, "upstream should not be called when the breaker is open")
+}
+
+func TestCachePassthroughHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=7200")
+		w.Header().Set("ETag", `"abc"`)
+		if r.Header.Get("If-None-Match") == `"abc"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "text/javascript")
+		w.Write([]byte("var ga"))
+	}))
+	defer upstream.Close()
+
+	config := LoadConfig()
+	config.GoogleOrigin = upstream.URL
+	app := Setup(config)
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/analytics.js", nil), -1)
+	assert.Nilf(t, err, "err should be nil")
+	assert.Empty(t, resp.Header.Get("ETag"), "headers should not be forwarded by default")
+
+	config.CachePassthroughHeaders = true
+	app = Setup(config)
+
+	resp, err = app.Test(httptest.NewRequest("GET", "/analytics.js", nil), -1)
+	assert.Nilf(t, err, "err should be nil")
+	assert.Equal(t, `"abc"`, resp.Header.Get("ETag"))
+	assert.Equal(t, "max-age=7200", resp.Header.Get("Cache-Control"))
+
+	req := httptest.NewRequest("GET", "/analytics.js", nil)
+	req.Header.Set("If-None-Match", `"abc"`)
+	resp, err = app.Test(req, -1)
+	assert.Nilf(t, err, "err should be nil")
+	assert.Equal(t, 304, resp.StatusCode)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nilf(t, err, "err should be nil")
+	assert.Empty(t, body)
+
+	req = httptest.NewRequest("GET", "/analytics.js", nil)
+	req.Header.Set("If-None-Match", `"other"`)
+	resp, err = app.Test(req, -1)
+	assert.Nilf(t, err, "err should be nil")
+	assert.Equal(t, 200, resp.StatusCode)
+
+	body, err = ioutil.ReadAll(resp.Body)
+	assert.Nilf(t, err, "err should be nil")
+	assert.Equal(t, "var ga", string(body))
+}
+
+func TestBodyReplaceContentTypes(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write([]byte(`{"endpoint":"https://www.google-analytics.com/g/collect","gtm":"https://www.googletagmanager.com/gtm.js"}`))
+	}))
+	defer upstream.Close()
+
+	config := LoadConfig()
+	config.GoogleOrigin = upstream.URL
+	app := Setup(config)
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/gtm.js?id=GTM-XXXX", nil), -1)
+	assert.Nilf(t, err, "err should be nil")
+
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nilf(t, err, "err should be nil")
+	assert.Contains(t, string(body), "google-analytics.com", "JSON should not be replaced by default")
+
+	config.BodyReplaceContentTypes = "text/javascript,application/javascript,application/json"
+	app = Setup(config)
+
+	resp, err = app.Test(httptest.NewRequest("GET", "/gtm.js?id=GTM-XXXX", nil), -1)
+	assert.Nilf(t, err, "err should be nil")
+
+	body, err = ioutil.ReadAll(resp.Body)
+	assert.Nilf(t, err, "err should be nil")
+	assert.Equal(t, `{"endpoint":"https://example.com/g/collect","gtm":"https://example.com/gtm.js"}`, string(body))
+}
+
+func TestPostBodyForwarding(t *testing.T) {
+	var upstreamBody, upstreamContentType, upstreamMethod string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		upstreamBody = string(body)
+		upstreamContentType = r.Header.Get("Content-Type")
+		upstreamMethod = r.Method
+	}))
+	defer upstream.Close()
+
+	config := LoadConfig()
+	config.GoogleOrigin = upstream.URL
+	app := Setup(config)
+
+	payload := "v=1&tid=UA-XXXXX-Y&cid=555&t=pageview&dp=%2Fhome"
+	req := httptest.NewRequest("POST", "/collect", strings.NewReader(payload))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := app.Test(req, -1)
+	assert.Nilf(t, err, "err should be nil")
+	assert.Equalf(t, 200, resp.StatusCode, "statusCode should be 200")
+
+	assert.Equal(t, "POST", upstreamMethod)
+	assert.Equal(t, payload, upstreamBody, "body should be forwarded")
+	assert.Equal(t, "application/x-www-form-urlencoded", upstreamContentType)
+}
+
+func TestRequestMaxBodySize(t *testing.T) {
+	var upstreamBody string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		upstreamBody = string(body)
+	}))
+	defer upstream.Close()
+
+	config := LoadConfig()
+	config.GoogleOrigin = upstream.URL
+	config.RequestMaxBodySize = "1KB"
+	app := Setup(config)
+
+	// The server closes the connection once the limit is exceeded, so use a real one
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go app.Listener(ln)
+	defer app.Shutdown()
+	endpoint := "http://" + ln.Addr().String() + "/batch"
+
+	payload := strings.Repeat("a", 1024)
+	resp, err := http.Post(endpoint, "text/plain", strings.NewReader(payload))
+	assert.Nilf(t, err, "err should be nil")
+	assert.Equal(t, 200, resp.StatusCode, "body of exactly the limit should be accepted")
+	assert.Equal(t, payload, upstreamBody)
+
+	upstreamBody = ""
+	resp, err = http.Post(endpoint, "text/plain", strings.NewReader(payload+"a"))
+	assert.Nilf(t, err, "err should be nil")
+	assert.Equal(t, 413, resp.StatusCode)
+	assert.Empty(t, upstreamBody, "should not be forwarded")
+
+	// Without Content-Length the body is streamed chunked
+	body := io.MultiReader(strings.NewReader(payload), strings.NewReader("a"))
+	resp, err = http.Post(endpoint, "text/plain", ioutil.NopCloser(body))
+	assert.Nilf(t, err, "err should be nil")
+	assert.Equal(t, 413, resp.StatusCode)
+	assert.Empty(t, upstreamBody, "should not be forwarded")
+
+	assert.Contains(t, getMetrics(t, app), "gaxy_requests_body_too_large_total 2")
+}
+
+func TestStripAndAddResponseHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "NID=1; Domain=google.com")
+		w.Header().Set("Cache-Control", "max-age=7200")
+		w.Header().Set("ETag", `"abc"`)
+	}))
+	defer upstream.Close()
+
+	config := LoadConfig()
+	config.GoogleOrigin = upstream.URL
+	config.CachePassthroughHeaders = true
+	config.StripResponseHeaders = append(config.StripResponseHeaders, "ETag")
+	config.AddResponseHeaders = []string{"X-Robots-Tag: noindex", "X-Served-By:gaxy"}
+	assert.Nil(t, config.Validate())
+	app := Setup(config)
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/analytics.js", nil), -1)
+	assert.Nilf(t, err, "err should be nil")
+
+	assert.Empty(t, resp.Header.Get("Set-Cookie"))
+	assert.Empty(t, resp.Header.Get("ETag"), "stripped header should be removed")
+	assert.Equal(t, "max-age=7200", resp.Header.Get("Cache-Control"))
+	assert.Equal(t, "noindex", resp.Header.Get("X-Robots-Tag"))
+	assert.Equal(t, "gaxy", resp.Header.Get("X-Served-By"))
+}
+
+func TestUpstreamMaxResponseSize(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/limit":
+			w.Write(bytes.Repeat([]byte("a"), 1024))
+		case "/chunked":
+			// Flushing before the end of the body sends it without Content-Length
+			w.Write(bytes.Repeat([]byte("a"), 512))
+			w.(http.Flusher).Flush()
+			w.Write(bytes.Repeat([]byte("a"), 513))
+		case "/analytics.js":
+			w.Header().Set("Content-Type", "text/javascript")
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(gzipBody(t, bytes.Repeat([]byte("a"), 1025)))
+		default:
+			w.Write(bytes.Repeat([]byte("a"), 1025))
+		}
+	}))
+	defer upstream.Close()
+
+	config := LoadConfig()
+	config.GoogleOrigin = upstream.URL
+	config.UpstreamMaxResponseSize = "1KB"
+	app := Setup(config)
+
+	for path, status := range map[string]int{"/limit": 200, "/collect": 502, "/chunked": 502, "/analytics.js": 502} {
+		resp, err := app.Test(httptest.NewRequest("GET", path, nil), -1)
+		assert.Nilf(t, err, "err should be nil")
+		assert.Equalf(t, status, resp.StatusCode, "unexpected status for %s", path)
+	}
+
+	u, _ := url.Parse(upstream.URL)
+	metrics := getMetrics(t, app)
+	assert.Contains(t, metrics, `gaxy_upstream_response_truncated_total{backend="`+u.Host+`"} 3`)
+}
+
+func gzipBody(t testing.TB, body []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(body)
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestContentEncodingPassthrough(t *testing.T) {
+	pixel := bytes.Repeat([]byte{0x47, 0x49, 0x46}, 100)
+	script := []byte("var u='https://www.google-analytics.com/collect'")
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		if r.URL.Path == "/analytics.js" {
+			w.Header().Set("Content-Type", "text/javascript")
+			w.Write(gzipBody(t, script))
+			return
+		}
+		w.Header().Set("Content-Type", "image/gif")
+		w.Write(gzipBody(t, pixel))
+	}))
+	defer upstream.Close()
+
+	config := LoadConfig()
+	config.GoogleOrigin = upstream.URL
+	app := Setup(config)
+
+	req := httptest.NewRequest("GET", "/collect", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := app.Test(req, -1)
+	assert.Nilf(t, err, "err should be nil")
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"), "encoding should be forwarded")
+
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nilf(t, err, "err should be nil")
+	assert.Equal(t, gzipBody(t, pixel), body, "body should be passed through compressed")
+
+	req = httptest.NewRequest("GET", "/analytics.js", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err = app.Test(req, -1)
+	assert.Nilf(t, err, "err should be nil")
+	assert.Empty(t, resp.Header.Get("Content-Encoding"), "replaced body should be decompressed")
+
+	body, err = ioutil.ReadAll(resp.Body)
+	assert.Nilf(t, err, "err should be nil")
+	assert.Equal(t, "var u='https://example.com/collect'", string(body))
+}
+
+func benchmarkImageResponse(b *testing.B, passthrough bool) {
+	config := LoadConfig()
+	body := gzipBody(b, bytes.Repeat([]byte{0x47, 0x49, 0x46, 0x38}, 4096))
+
+	upstreamResp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(upstreamResp)
+	upstreamResp.Header.SetContentType("image/gif")
+	upstreamResp.Header.Set("Content-Encoding", "gzip")
+	upstreamResp.SetBody(body)
+
+	app := fiber.New()
+	c := app.AcquireCtx(&fasthttp.RequestCtx{})
+	defer app.ReleaseCtx(c)
+	c.Locals("config", config)
+
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if passthrough {
+			if err := postprocessResponse(upstreamResp, c); err != nil {
+				b.Fatal(err)
+			}
+			continue
+		}
+
+		// Previous behaviour, decompress every body
+		bodyString, err := GetBodyString(upstreamResp, 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+		c.Response().SetBodyString(bodyString)
+	}
+}
+
+func BenchmarkImageResponsePassthrough(b *testing.B) {
+	benchmarkImageResponse(b, true)
+}
+
+func BenchmarkImageResponseDecompress(b *testing.B) {
+	benchmarkImageResponse(b, false)
+}
+
+func TestStrictGA4Validation(t *testing.T) {
+	var upstreamPath string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamPath = r.URL.Path
+	}))
+	defer upstream.Close()
+
+	config := LoadConfig()
+	config.GoogleOrigin = upstream.URL
+	config.RoutePrefix = "/analytics"
+	config.StrictGA4Validation = true
+	app := Setup(config)
+
+	cases := []struct {
+		target string
+		status int
+	}{
+		{"/mp/collect?measurement_id=G-1&api_secret=s3cr3t", 200},
+		{"/analytics/mp/collect?measurement_id=G-1&api_secret=s3cr3t", 200},
+		{"/debug/mp/collect?measurement_id=G-1&api_secret=s3cr3t", 200},
+		{"/mp/collect?measurement_id=G-1", 400},
+		{"/analytics/mp/collect?measurement_id=G-1&api_secret=", 400},
+		{"/debug/mp/collect?measurement_id=G-1", 400},
+		{"/g/collect?tid=G-1", 200},
+		{"/gtag/event?tid=G-1", 200},
+	}
+	for _, tc := range cases {
+		upstreamPath = ""
+		resp, err := app.Test(httptest.NewRequest("POST", tc.target, nil), -1)
+		assert.Nilf(t, err, "err should be nil")
+		assert.Equalf(t, tc.status, resp.StatusCode, "unexpected status for %s", tc.target)
+
+		if tc.status == 400 {
+			body, _ := ioutil.ReadAll(resp.Body)
+			assert.Contains(t, string(body), "missing api_secret")
+			assert.Empty(t, upstreamPath, "should not be forwarded")
+		}
+	}
+
+	config.StrictGA4Validation = false
+	resp, err := Setup(config).Test(httptest.NewRequest("POST", "/mp/collect?measurement_id=G-1", nil), -1)
+	assert.Nilf(t, err, "err should be nil")
+	assert.Equal(t, 200, resp.StatusCode, "should not validate by default")
+}
+
+func TestRoutePrefixRegex(t *testing.T) {
+	var upstreamPath string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamPath = r.URL.Path
+		w.Header().Set("Content-Type", "text/javascript")
+		w.Write([]byte(`var u="https://www.google-analytics.com/collect";`))
+	}))
+	defer upstream.Close()
+
+	config := LoadConfig()
+	config.GoogleOrigin = upstream.URL
+	config.RoutePrefix = `/(analytics|stats)-v[0-9]+`
+	config.RoutePrefixRegex = true
+	assert.Nil(t, config.Validate())
+	app := Setup(config)
+
+	get := func(path string) (int, string) {
+		resp, err := app.Test(httptest.NewRequest("GET", path, nil), -1)
+		assert.Nil(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	status, body := get("/analytics-v2/analytics.js")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "/analytics.js", upstreamPath, "matching prefix should be trimmed")
+	assert.Equal(t, `var u="https://example.com/analytics-v2/collect";`, body, "matched prefix should be used in the body")
+
+	status, _ = get("/stats-v10/collect")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "/collect", upstreamPath, "capture group should be matched")
+
+	status, _ = get("/other-v1/collect")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "/other-v1/collect", upstreamPath, "not matching prefix should be kept")
+
+	status, body = get("/analytics-v2/ping")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "pong", body)
+
+	status, body = get("/analytics.js")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, `var u="https://example.com/collect";`, body)
+
+	config.RoutePrefix = "/analytics-v[0-9"
+	assert.NotNil(t, config.Validate(), "invalid regular expression should be rejected")
+
+	config.RoutePrefixRegex = false
+	assert.Nil(t, config.Validate())
+}
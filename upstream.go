@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Upstream is a backend requests are proxied to
+type Upstream struct {
+	URL     *url.URL
+	Weight  int
+	Breaker *CircuitBreaker
+
+	current int
+}
+
+// UpstreamPool selects an upstream using smooth weighted round-robin,
+// skipping the upstreams whose circuit breaker is open
+type UpstreamPool struct {
+	// Client sends the requests to the upstreams
+	Client *fasthttp.Client
+
+	mu        sync.Mutex
+	upstreams []*Upstream
+	dnsCache  *DNSCache
+	http2     *HTTP2Client
+
+	// Semaphore of UPSTREAM_MAX_CONCURRENT, nil if unlimited
+	sem        chan struct{}
+	semTimeout time.Duration
+	onBlocked  func()
+}
+
+// NewUpstreamPool create a pool from GOOGLE_ORIGINS/UPSTREAM_WEIGHTS,
+// or from GOOGLE_ORIGIN when GOOGLE_ORIGINS is not set
+func NewUpstreamPool(config Config) (*UpstreamPool, error) {
+	origins, weights, err := config.GetUpstreams()
+	if err != nil {
+		return nil, err
+	}
+
+	maxResponseSize, err := config.GetUpstreamMaxResponseSize()
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := config.GetUpstreamTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	pool := &UpstreamPool{
+		Client: &fasthttp.Client{
+			MaxResponseBodySize: maxResponseSize,
+			TLSConfig:           tlsConfig,
+		},
+	}
+	if config.UpstreamDNSCacheTTL > 0 {
+		pool.dnsCache = NewDNSCache(net.DefaultResolver, config.UpstreamDNSCacheTTL)
+	}
+	dialer := newUpstreamDialer(pool.dnsCache)
+	pool.Client.DialTimeout = func(addr string, timeout time.Duration) (net.Conn, error) {
+		// No timeout when the request has no deadline, use the default one
+		if timeout <= 0 {
+			return dialer.Dial(addr)
+		}
+		return dialer.DialTimeout(addr, timeout)
+	}
+	if config.UpstreamMaxConcurrent > 0 {
+		pool.sem = make(chan struct{}, config.UpstreamMaxConcurrent)
+		pool.semTimeout = config.UpstreamConcurrencyTimeout
+	}
+	if config.UpstreamHTTP2 {
+		pool.http2 = NewHTTP2Client(tlsConfig, dialer.Dial, maxResponseSize)
+	}
+	for i, origin := range origins {
+		u, err := url.Parse(origin)
+		if err != nil {
+			return nil, err
+		}
+		pool.upstreams = append(pool.upstreams, &Upstream{
+			URL:     u,
+			Weight:  weights[i],
+			Breaker: NewCircuitBreaker(config.UpstreamCBThreshold, config.UpstreamCBTimeout),
+		})
+	}
+
+	return pool, nil
+}
+
+// Do send req to the upstream with the HTTP/2 client when UPSTREAM_HTTP2 is set,
+// or with the fasthttp client, until the deadline if not zero
+func (p *UpstreamPool) Do(req *fasthttp.Request, resp *fasthttp.Response, deadline time.Time) error {
+	if p.http2 != nil {
+		return p.http2.DoDeadline(req, resp, deadline)
+	}
+	if deadline.IsZero() {
+		return p.Client.Do(req, resp)
+	}
+
+	return p.Client.DoDeadline(req, resp, deadline)
+}
+
+// ErrUpstreamBusy is returned when no UPSTREAM_MAX_CONCURRENT slot was freed in time
+var ErrUpstreamBusy = errors.New("too many concurrent upstream requests")
+
+// DoWithContext send req like Do in one of the UPSTREAM_MAX_CONCURRENT slots,
+// until the deadline of ctx if any. Only the deadline is applied: fasthttp can
+// not abort a request in flight, it closes the connection at the deadline.
+func (p *UpstreamPool) DoWithContext(ctx context.Context, req *fasthttp.Request, resp *fasthttp.Response) error {
+	if !p.acquire(ctx) {
+		return ErrUpstreamBusy
+	}
+	defer p.release()
+
+	deadline, _ := ctx.Deadline()
+	return p.Do(req, resp, deadline)
+}
+
+// Take one of the UPSTREAM_MAX_CONCURRENT slots, waiting up to UPSTREAM_CONCURRENCY_TIMEOUT
+// or until ctx is done. It returns false if no slot was freed in time.
+func (p *UpstreamPool) acquire(ctx context.Context) bool {
+	if p.sem == nil {
+		return true
+	}
+
+	select {
+	case p.sem <- struct{}{}:
+		return true
+	default:
+	}
+
+	if p.onBlocked != nil {
+		p.onBlocked()
+	}
+	timer := time.NewTimer(p.semTimeout)
+	defer timer.Stop()
+
+	select {
+	case p.sem <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Free the slot taken by acquire
+func (p *UpstreamPool) release() {
+	if p.sem != nil {
+		<-p.sem
+	}
+}
+
+// RecordConcurrencyEvents record the requests waiting for an UPSTREAM_MAX_CONCURRENT slot in metrics
+func (p *UpstreamPool) RecordConcurrencyEvents(metrics *Metrics) {
+	p.onBlocked = metrics.RecordUpstreamConcurrencyBlocked
+}
+
+// RecordCircuitEvents record the circuit breaker transitions of the upstreams in metrics
+func (p *UpstreamPool) RecordCircuitEvents(metrics *Metrics) {
+	for _, u := range p.upstreams {
+		backend := u.URL.Host
+		u.Breaker.OnStateChange = func(state CircuitState) {
+			switch state {
+			case CircuitOpen:
+				metrics.RecordCircuitEvent(backend, CircuitEventOpen)
+			case CircuitHalfOpen:
+				metrics.RecordCircuitEvent(backend, CircuitEventHalfOpenProbe)
+			default:
+				metrics.RecordCircuitEvent(backend, CircuitEventClose)
+			}
+		}
+	}
+}
+
+// Next returns the next available upstream, or nil if all of them are down
+func (p *UpstreamPool) Next() *Upstream {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var selected *Upstream
+	total := 0
+	for _, u := range p.upstreams {
+		if !u.Breaker.Available() {
+			continue
+		}
+		u.current += u.Weight
+		total += u.Weight
+		if selected == nil || u.current > selected.current {
+			selected = u
+		}
+	}
+
+	if selected != nil {
+		selected.current -= total
+	}
+
+	return selected
+}
+
+// RecordDNSCacheEvents record the hits and misses of the upstream DNS cache in metrics
+func (p *UpstreamPool) RecordDNSCacheEvents(metrics *Metrics) {
+	if p.dnsCache == nil {
+		return
+	}
+
+	p.dnsCache.OnHit = func() { metrics.RecordDNSCacheLookup(true) }
+	p.dnsCache.OnMiss = func() { metrics.RecordDNSCacheLookup(false) }
+}
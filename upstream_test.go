@@ -0,0 +1,537 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func TestUpstreamPoolWeightedRoundRobin(t *testing.T) {
+	config := LoadConfig()
+	config.GoogleOrigins = "https://a.example.com,https://b.example.com"
+	config.UpstreamWeights = "3,1"
+
+	pool, err := NewUpstreamPool(config)
+	assert.Nil(t, err)
+
+	counts := map[string]int{}
+	for i := 0; i < 8; i++ {
+		counts[pool.Next().URL.Host]++
+	}
+
+	assert.Equal(t, 6, counts["a.example.com"])
+	assert.Equal(t, 2, counts["b.example.com"])
+}
+
+func TestUpstreamPoolSkipOpenBreaker(t *testing.T) {
+	config := LoadConfig()
+	config.GoogleOrigins = "https://a.example.com,https://b.example.com"
+	config.UpstreamCBThreshold = 1
+	config.UpstreamCBTimeout = time.Minute
+
+	pool, err := NewUpstreamPool(config)
+	assert.Nil(t, err)
+
+	down := pool.Next()
+	down.Breaker.Failure()
+
+	for i := 0; i < 4; i++ {
+		assert.NotEqual(t, down, pool.Next(), "upstream with open breaker should be out of rotation")
+	}
+
+	pool.Next().Breaker.Failure()
+	assert.Nil(t, pool.Next(), "no upstream should be available")
+}
+
+func TestUpstreamPoolInvalidWeights(t *testing.T) {
+	config := LoadConfig()
+	config.GoogleOrigins = "https://a.example.com,https://b.example.com"
+	config.UpstreamWeights = "1"
+
+	_, err := NewUpstreamPool(config)
+	assert.NotNil(t, err)
+}
+
+// Create a certificate signed by parent (self-signed if nil), written as PEM files in dir
+func writeTestCert(t *testing.T, dir, name string, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+
+	return cert, key
+}
+
+func TestUpstreamMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	notAfter := time.Now().Add(time.Hour)
+
+	ca, caKey := writeTestCert(t, dir, "ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gaxy test CA"},
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil, nil)
+	writeTestCert(t, dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	writeTestCert(t, dir, "client", &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "gaxy"},
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	serverCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"))
+	assert.Nil(t, err)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca)
+
+	var clientName string
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientName = r.TLS.PeerCertificates[0].Subject.CommonName
+	}))
+	upstream.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	config := LoadConfig()
+	config.GoogleOrigin = upstream.URL
+	config.UpstreamTLSCAFile = filepath.Join(dir, "ca.crt")
+
+	// Without the client certificate the handshake fails
+	resp, err := Setup(config).Test(httptest.NewRequest("GET", "/collect", nil), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 500, resp.StatusCode)
+
+	config.UpstreamTLSCertFile = filepath.Join(dir, "client.crt")
+	config.UpstreamTLSKeyFile = filepath.Join(dir, "client.key")
+	assert.Nil(t, config.Validate())
+
+	resp, err = Setup(config).Test(httptest.NewRequest("GET", "/collect", nil), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "gaxy", clientName)
+}
+
+func TestUpstreamTLSConfigInvalid(t *testing.T) {
+	dir := t.TempDir()
+	notPEM := filepath.Join(dir, "invalid.pem")
+	assert.Nil(t, os.WriteFile(notPEM, []byte("not a certificate"), 0o600))
+
+	config := LoadConfig()
+	tlsConfig, err := config.GetUpstreamTLSConfig()
+	assert.Nil(t, err)
+	assert.Nil(t, tlsConfig, "should use the default TLS config")
+
+	config.UpstreamTLSCertFile = notPEM
+	assert.NotNil(t, config.Validate(), "key file should be required")
+
+	config.UpstreamTLSKeyFile = notPEM
+	assert.NotNil(t, config.Validate())
+
+	config = LoadConfig()
+	config.UpstreamTLSCAFile = notPEM
+	assert.NotNil(t, config.Validate())
+
+	config.UpstreamTLSCAFile = filepath.Join(dir, "missing.pem")
+	assert.NotNil(t, config.Validate())
+}
+
+func TestUpstreamOverrideHeader(t *testing.T) {
+	var defaultHits int
+	defaultUpstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defaultHits++
+	}))
+	defer defaultUpstream.Close()
+
+	var overrideHits int
+	var forwardedHeader string
+	overrideUpstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		overrideHits++
+		forwardedHeader = r.Header.Get("X-GA-Upstream")
+	}))
+	defer overrideUpstream.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	assert.Nil(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: overrideUpstream.Certificate().Raw}), 0o600))
+
+	config := LoadConfig()
+	config.GoogleOrigin = defaultUpstream.URL
+	config.UpstreamTLSCAFile = caFile
+
+	send := func(app *fiber.App, upstream string) int {
+		req := httptest.NewRequest("GET", "/mp/collect", nil)
+		req.Header.Set("X-GA-Upstream", upstream)
+		resp, err := app.Test(req, -1)
+		assert.Nil(t, err)
+		return resp.StatusCode
+	}
+
+	// Disabled by default, the header is ignored
+	assert.Equal(t, 200, send(Setup(config), overrideUpstream.URL))
+	assert.Equal(t, 1, defaultHits)
+	assert.Equal(t, 0, overrideHits)
+
+	config.AllowUpstreamOverrideHeader = true
+	assert.NotNil(t, config.Validate(), "UPSTREAM_ALLOWED_HOSTS should be required")
+
+	config.UpstreamAllowedHosts = "*.google-analytics.com, 127.0.0.1"
+	assert.Nil(t, config.Validate())
+	app := Setup(config)
+
+	assert.Equal(t, 200, send(app, overrideUpstream.URL))
+	assert.Equal(t, 1, overrideHits)
+	assert.Empty(t, forwardedHeader, "header should not be forwarded")
+
+	assert.Equal(t, 400, send(app, "https://evil.example.com"), "host should be allowed")
+	assert.Equal(t, 400, send(app, "http://127.0.0.1"), "scheme should be https")
+	assert.Equal(t, 400, send(app, "://"))
+	assert.Equal(t, 1, overrideHits)
+
+	assert.True(t, config.IsUpstreamHostAllowed("region1.Google-Analytics.com"))
+	assert.False(t, config.IsUpstreamHostAllowed("google-analytics.com.evil.com"))
+
+	config.UpstreamAllowedHosts = "[invalid"
+	assert.NotNil(t, config.Validate())
+}
+
+// Start a TLS upstream serving HTTP/2, and write its certificate as CA file for the config
+func newHTTP2Upstream(t testing.TB, handler http.HandlerFunc) (*httptest.Server, string) {
+	upstream := httptest.NewUnstartedServer(handler)
+	upstream.EnableHTTP2 = true
+	upstream.StartTLS()
+
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	assert.Nil(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw}), 0o600))
+
+	return upstream, caFile
+}
+
+func TestUpstreamHTTP2(t *testing.T) {
+	var protocol, query string
+	upstream, caFile := newHTTP2Upstream(t, func(w http.ResponseWriter, r *http.Request) {
+		protocol = r.Proto
+		query = r.URL.RawQuery
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("ok"))
+	})
+	defer upstream.Close()
+
+	config := LoadConfig()
+	config.GoogleOrigin = upstream.URL
+	config.UpstreamTLSCAFile = caFile
+	config.UpstreamHTTP2 = true
+	config.UpstreamCBThreshold = 1
+	config.UpstreamCBTimeout = time.Minute
+	config.RouteTimeouts = `{"/slow":"50ms"}`
+	assert.Nil(t, config.Validate())
+	app := Setup(config)
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/collect?v=1&tid=UA-1", nil), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "HTTP/2.0", protocol)
+	assert.Contains(t, query, "v=1&tid=UA-1")
+
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, "ok", string(body))
+
+	resp, err = app.Test(httptest.NewRequest("GET", "/slow", nil), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 504, resp.StatusCode, "deadline should be applied")
+
+	// The breaker opens on failures, as with the fasthttp client
+	resp, err = app.Test(httptest.NewRequest("GET", "/collect", nil), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 503, resp.StatusCode)
+}
+
+func TestUpstreamHTTP2MaxResponseSize(t *testing.T) {
+	upstream, caFile := newHTTP2Upstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 2048))
+	})
+	defer upstream.Close()
+
+	config := LoadConfig()
+	config.GoogleOrigin = upstream.URL
+	config.UpstreamTLSCAFile = caFile
+	config.UpstreamHTTP2 = true
+	config.UpstreamMaxResponseSize = "1KB"
+
+	resp, err := Setup(config).Test(httptest.NewRequest("GET", "/collect", nil), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 502, resp.StatusCode)
+}
+
+func benchmarkUpstreamClient(b *testing.B, http2 bool) {
+	upstream, caFile := newHTTP2Upstream(b, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	defer upstream.Close()
+
+	config := LoadConfig()
+	config.GoogleOrigin = upstream.URL
+	config.UpstreamTLSCAFile = caFile
+	config.UpstreamHTTP2 = http2
+	pool, err := NewUpstreamPool(config)
+	assert.Nil(b, err)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		req := fasthttp.AcquireRequest()
+		resp := fasthttp.AcquireResponse()
+		defer fasthttp.ReleaseRequest(req)
+		defer fasthttp.ReleaseResponse(resp)
+
+		req.SetRequestURI(upstream.URL + "/collect?v=1")
+		for pb.Next() {
+			if err := pool.Do(req, resp, time.Time{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkUpstreamClientHTTP1(b *testing.B) {
+	benchmarkUpstreamClient(b, false)
+}
+
+func BenchmarkUpstreamClientHTTP2(b *testing.B) {
+	benchmarkUpstreamClient(b, true)
+}
+
+func TestUpstreamMaxConcurrent(t *testing.T) {
+	var inFlight, maxInFlight int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}))
+	defer upstream.Close()
+
+	config := LoadConfig()
+	config.GoogleOrigin = upstream.URL
+	config.UpstreamMaxConcurrent = 2
+	assert.Nil(t, config.Validate())
+	app := Setup(config)
+
+	send := func(app *fiber.App, statuses chan<- int) {
+		resp, err := app.Test(httptest.NewRequest("GET", "/collect", nil), -1)
+		assert.Nil(t, err)
+		statuses <- resp.StatusCode
+	}
+
+	statuses := make(chan int, 10)
+	for i := 0; i < 10; i++ {
+		go send(app, statuses)
+	}
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, 200, <-statuses)
+	}
+	assert.Equal(t, int32(2), maxInFlight, "at most 2 requests should be in flight")
+
+	// Requests waiting longer than UPSTREAM_CONCURRENCY_TIMEOUT are rejected
+	config.UpstreamMaxConcurrent = 1
+	config.UpstreamConcurrencyTimeout = 10 * time.Millisecond
+	app = Setup(config)
+
+	go send(app, statuses)
+	go send(app, statuses)
+	assert.ElementsMatch(t, []int{200, 503}, []int{<-statuses, <-statuses})
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/metrics", nil), -1)
+	assert.Nil(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Contains(t, string(body), "gaxy_upstream_concurrency_blocked_total 1\n")
+
+	config.UpstreamMaxConcurrent = -1
+	assert.NotNil(t, config.Validate())
+}
+
+// countedConn decrements open once closed
+type countedConn struct {
+	net.Conn
+	open *int32
+	once sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() { atomic.AddInt32(c.open, -1) })
+	return c.Conn.Close()
+}
+
+func TestUpstreamMaxConcurrentTimeout(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			// Until gaxy closes the connection
+			select {
+			case <-time.After(300 * time.Millisecond):
+			case <-r.Context().Done():
+			}
+		}
+	}))
+	defer upstream.Close()
+
+	config := LoadConfig()
+	config.GoogleOrigin = upstream.URL
+	config.UpstreamMaxConcurrent = 2
+	config.UpstreamCBThreshold = 0
+	config.RouteTimeouts = `{"/slow":"50ms"}`
+	assert.Nil(t, config.Validate())
+	app := Setup(config)
+
+	statuses := make(chan int, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			resp, err := app.Test(httptest.NewRequest("GET", "/slow", nil), -1)
+			assert.Nil(t, err)
+			statuses <- resp.StatusCode
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		assert.Contains(t, []int{503, 504}, <-statuses, "should time out waiting for the upstream or a slot")
+	}
+
+	// The timed out requests free their slot
+	resp, err := app.Test(httptest.NewRequest("GET", "/collect", nil), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	// The upstream notices the closed connections late, count the requests in
+	// flight on gaxy side: each one has its own connection, closed before its
+	// slot is released
+	pool, err := NewUpstreamPool(config)
+	assert.Nil(t, err)
+	var open, maxOpen int32
+	dial := pool.Client.DialTimeout
+	pool.Client.DialTimeout = func(addr string, timeout time.Duration) (net.Conn, error) {
+		conn, err := dial(addr, timeout)
+		if err != nil {
+			return nil, err
+		}
+		n := atomic.AddInt32(&open, 1)
+		for {
+			max := atomic.LoadInt32(&maxOpen)
+			if n <= max || atomic.CompareAndSwapInt32(&maxOpen, max, n) {
+				break
+			}
+		}
+		return &countedConn{Conn: conn, open: &open}, nil
+	}
+
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			req := fasthttp.AcquireRequest()
+			resp := fasthttp.AcquireResponse()
+			defer fasthttp.ReleaseRequest(req)
+			defer fasthttp.ReleaseResponse(resp)
+			req.SetRequestURI(upstream.URL + "/slow")
+			req.SetConnectionClose()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			errs <- pool.DoWithContext(ctx, req, resp)
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		err := <-errs
+		assert.True(t, err == ErrUpstreamBusy || isUpstreamTimeout(err), "unexpected error %v", err)
+	}
+	assert.Greater(t, atomic.LoadInt32(&maxOpen), int32(0))
+	assert.LessOrEqual(t, atomic.LoadInt32(&maxOpen), int32(2), "at most 2 requests should be in flight")
+	assert.Equal(t, 0, len(pool.sem), "the slots should be released")
+}
+
+func TestUpstreamDoWithContext(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(500 * time.Millisecond)
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	config := LoadConfig()
+	config.GoogleOrigin = upstream.URL
+	config.UpstreamMaxConcurrent = 1
+	pool, err := NewUpstreamPool(config)
+	assert.Nil(t, err)
+
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.SetRequestURI(upstream.URL + "/collect")
+	assert.Nil(t, pool.DoWithContext(context.Background(), req, resp))
+	assert.Equal(t, "ok", string(resp.Body()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	req.SetRequestURI(upstream.URL + "/slow")
+	assert.Equal(t, fasthttp.ErrTimeout, pool.DoWithContext(ctx, req, resp))
+	assert.Less(t, time.Since(start), 200*time.Millisecond, "should return at the deadline")
+
+	// The connection is closed at the deadline, the slot is free
+	req.SetRequestURI(upstream.URL + "/collect")
+	assert.Nil(t, pool.DoWithContext(context.Background(), req, resp))
+}
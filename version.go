@@ -0,0 +1,22 @@
+package main
+
+import (
+	"github.com/gofiber/fiber/v2"
+)
+
+// Build information, set at build time with
+// -ldflags "-X main.Version=$(git describe --tags) -X main.BuildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ) -X main.GitCommit=$(git rev-parse HEAD)"
+var (
+	Version   = "dev"
+	BuildTime = "unknown"
+	GitCommit = "unknown"
+)
+
+// Version handler, returns the build information
+func versionHandler(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"version":    Version,
+		"build_time": BuildTime,
+		"git_commit": GitCommit,
+	})
+}
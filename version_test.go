@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVersionEndpoint(t *testing.T) {
+	version, buildTime, gitCommit := Version, BuildTime, GitCommit
+	defer func() {
+		Version, BuildTime, GitCommit = version, buildTime, gitCommit
+	}()
+	Version = "v1.2.3"
+	BuildTime = "2024-01-02T03:04:05Z"
+	GitCommit = "0123456789abcdef"
+
+	config := LoadConfig()
+	config.RoutePrefix = "/analytics"
+	app := Setup(config)
+
+	for _, path := range []string{"/version", "/analytics/version"} {
+		resp, err := app.Test(httptest.NewRequest("GET", path, nil), -1)
+		assert.Nil(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		var body map[string]string
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Equal(t, map[string]string{
+			"version":    "v1.2.3",
+			"build_time": "2024-01-02T03:04:05Z",
+			"git_commit": "0123456789abcdef",
+		}, body)
+	}
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/metrics", nil), -1)
+	assert.Nil(t, err)
+	metrics, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Contains(t, string(metrics), `gaxy_info{version="v1.2.3",build_time="2024-01-02T03:04:05Z",git_commit="0123456789abcdef"} 1`)
+}